@@ -16,7 +16,7 @@ CREATE TABLE posts (
     is_liked BOOLEAN DEFAULT false,
     time_added BIGINT,
     user_id INTEGER NOT NULL,
-    FOREIGN KEY (user_id) REFERENCES users(id)
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
 CREATE INDEX idx_users_email ON users (email);
@@ -35,3 +35,286 @@ ALTER TABLE posts
 ADD COLUMN embedding vector(1536);
 
 CREATE INDEX ON posts USING hnsw (embedding vector_ip_ops);
+
+-- imports from other read-it-later services
+CREATE TABLE imports (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    format TEXT NOT NULL,
+    created_at BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- status is one of pending, processing, done, failed
+CREATE TABLE import_items (
+    id SERIAL PRIMARY KEY,
+    import_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
+    time_added BIGINT NOT NULL,
+    is_read BOOLEAN NOT NULL DEFAULT false,
+    is_liked BOOLEAN NOT NULL DEFAULT false,
+    status TEXT NOT NULL DEFAULT 'pending',
+    error TEXT NOT NULL DEFAULT '',
+    post_id INTEGER,
+    FOREIGN KEY (import_id) REFERENCES imports(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_import_items_import_id ON import_items (import_id);
+CREATE INDEX idx_import_items_pending ON import_items (id) WHERE status = 'pending';
+
+-- when posts were marked read and liked, for exports
+ALTER TABLE posts ADD COLUMN time_read BIGINT;
+ALTER TABLE posts ADD COLUMN time_liked BIGINT;
+
+-- previous versions of posts, kept when a post is refetched
+CREATE TABLE post_revisions (
+    id SERIAL PRIMARY KEY,
+    post_id INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at BIGINT NOT NULL,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_post_revisions_post_id ON post_revisions (post_id);
+
+-- normalized url used to detect posts which were already saved
+ALTER TABLE posts ADD COLUMN canonical_url TEXT;
+
+CREATE UNIQUE INDEX idx_posts_user_id_canonical_url ON posts (user_id, canonical_url);
+
+-- article metadata found by the extractor, empty/null if the page didn't have it
+ALTER TABLE posts ADD COLUMN byline TEXT;
+ALTER TABLE posts ADD COLUMN site_name TEXT;
+ALTER TABLE posts ADD COLUMN excerpt TEXT;
+ALTER TABLE posts ADD COLUMN lead_image TEXT;
+ALTER TABLE posts ADD COLUMN time_published BIGINT;
+
+-- number of words in the body, for reading time estimates and length filters
+ALTER TABLE posts ADD COLUMN word_count INTEGER;
+
+-- the post lists are paged by time_added, which has always been set on save
+UPDATE posts SET time_added = 0 WHERE time_added IS NULL;
+ALTER TABLE posts ALTER COLUMN time_added SET NOT NULL;
+
+CREATE INDEX idx_posts_user_id_is_read_time_added ON posts (user_id, is_read, time_added);
+
+-- posts move through inbox -> reading -> archived, and can be trashed from any of
+-- them. liked stays a separate flag. read posts become archived.
+ALTER TABLE posts ADD COLUMN state TEXT NOT NULL DEFAULT 'inbox'
+    CHECK (state IN ('inbox', 'reading', 'archived', 'trashed'));
+ALTER TABLE posts ADD COLUMN trashed_from TEXT;
+ALTER TABLE posts ADD COLUMN time_trashed BIGINT;
+
+UPDATE posts SET state = 'archived' WHERE is_read;
+
+ALTER TABLE posts RENAME COLUMN time_read TO time_archived;
+
+-- also drops the indexes on is_read
+ALTER TABLE posts DROP COLUMN is_read;
+
+CREATE INDEX idx_posts_user_id_state_time_added ON posts (user_id, state, time_added);
+CREATE INDEX idx_posts_time_trashed ON posts (time_trashed) WHERE state = 'trashed';
+
+-- how far the user has read a post, as a percentage and the block they were at
+ALTER TABLE posts ADD COLUMN read_progress REAL NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN progress_anchor TEXT;
+
+-- related posts are cached on each post along with the library version they were
+-- computed at. the version is bumped whenever one of the user's posts gets a new
+-- embedding, which invalidates all of the user's cached related posts.
+ALTER TABLE users ADD COLUMN library_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN related_post_ids INTEGER[];
+ALTER TABLE posts ADD COLUMN related_version INTEGER;
+
+-- posts are grouped into topics by clustering their embeddings. topics_version is
+-- the library_version the topics were last computed at, and topics_post_count the
+-- number of posts at the last full clustering.
+CREATE TABLE topics (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    label TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    time_updated BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_topics_user_id ON topics (user_id);
+
+ALTER TABLE posts ADD COLUMN topic_id INTEGER REFERENCES topics(id) ON DELETE SET NULL;
+CREATE INDEX idx_posts_topic_id ON posts (topic_id);
+
+ALTER TABLE users ADD COLUMN topics_version INTEGER;
+ALTER TABLE users ADD COLUMN topics_post_count INTEGER NOT NULL DEFAULT 0;
+
+-- user defined tags on posts, which are also suggested for new posts
+CREATE TABLE tags (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE post_tags (
+    post_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (post_id, tag_id),
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_post_tags_tag_id ON post_tags (tag_id);
+
+-- summaries are opt in per user. posts are queued for summarizing by setting
+-- summary_status to pending, a background worker then fills in the summary.
+ALTER TABLE users ADD COLUMN summaries_enabled BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE posts ADD COLUMN summary_status TEXT
+    CHECK (summary_status IN ('pending', 'processing', 'done', 'failed'));
+ALTER TABLE posts ADD COLUMN summary_tldr TEXT;
+ALTER TABLE posts ADD COLUMN summary_points TEXT[];
+ALTER TABLE posts ADD COLUMN time_summarized BIGINT;
+
+CREATE INDEX idx_posts_summary_pending ON posts (id) WHERE summary_status = 'pending';
+
+-- search results are cached with an etag made from posts_version, which a trigger
+-- bumps whenever one of the user's posts is saved, deleted or changes in a way that
+-- shows in the results
+ALTER TABLE users ADD COLUMN posts_version BIGINT NOT NULL DEFAULT 0;
+
+CREATE FUNCTION bump_posts_version() RETURNS trigger AS $$
+BEGIN
+    UPDATE users SET posts_version = posts_version + 1
+    WHERE id = (CASE WHEN TG_OP = 'DELETE' THEN OLD.user_id ELSE NEW.user_id END);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER posts_version_insert_delete AFTER INSERT OR DELETE ON posts
+    FOR EACH ROW EXECUTE FUNCTION bump_posts_version();
+CREATE TRIGGER posts_version_update AFTER UPDATE OF url, title, state, is_liked, read_progress, byline,
+    site_name, excerpt, time_published, word_count, embedding ON posts
+    FOR EACH ROW EXECUTE FUNCTION bump_posts_version();
+
+-- embeddings of search queries, when the query cache is persisted (LS2_QUERY_CACHE_DB)
+CREATE TABLE query_embeddings (
+    model TEXT NOT NULL,
+    query TEXT NOT NULL,
+    embedding vector NOT NULL,
+    time_used BIGINT NOT NULL,
+    PRIMARY KEY (model, query)
+);
+
+CREATE INDEX idx_query_embeddings_time_used ON query_embeddings (time_used);
+
+-- tokens used embedding posts and queries, per user and day (UTC)
+CREATE TABLE embedding_usage (
+    user_id INTEGER NOT NULL,
+    day DATE NOT NULL,
+    tokens BIGINT NOT NULL DEFAULT 0,
+    requests INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- the model and dimensions of each post's embedding, and the ones search uses. While
+-- posts are re-embedded with another model, next_model and next_dimensions are set and
+-- the new embeddings go in posts.embedding_next, which the app adds and swaps in itself
+ALTER TABLE posts ADD COLUMN embedding_model TEXT, ADD COLUMN embedding_dimensions INTEGER;
+
+UPDATE posts SET embedding_model = 'text-embedding-3-small', embedding_dimensions = 1536
+WHERE embedding IS NOT NULL;
+
+CREATE TABLE embedding_config (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    model TEXT NOT NULL,
+    dimensions INTEGER NOT NULL,
+    next_model TEXT,
+    next_dimensions INTEGER
+);
+
+INSERT INTO embedding_config (model, dimensions) VALUES ('text-embedding-3-small', 1536);
+
+-- the language of each post as an ISO 639-1 code, detected when it's saved. '' if it
+-- couldn't be told, NULL for posts saved before detection existed until
+-- `lucentsave backfill-languages` is run
+ALTER TABLE posts ADD COLUMN language TEXT;
+
+-- the text search configuration posts in a language are indexed with, which has to
+-- agree with textSearchConfigs in language.go. Posts of unknown language aren't
+-- stemmed, posts not detected yet are indexed as English like before. Changing this
+-- doesn't reindex existing posts, the tsvector column has to be added again for that
+CREATE FUNCTION language_ts_config(language TEXT) RETURNS regconfig AS $$
+    SELECT CASE coalesce(language, 'en')
+        WHEN 'en' THEN 'english'::regconfig
+        WHEN 'de' THEN 'german'::regconfig
+        WHEN 'fr' THEN 'french'::regconfig
+        WHEN 'es' THEN 'spanish'::regconfig
+        WHEN 'it' THEN 'italian'::regconfig
+        WHEN 'pt' THEN 'portuguese'::regconfig
+        WHEN 'nl' THEN 'dutch'::regconfig
+        WHEN 'sv' THEN 'swedish'::regconfig
+        WHEN 'da' THEN 'danish'::regconfig
+        WHEN 'fi' THEN 'finnish'::regconfig
+        WHEN 'ru' THEN 'russian'::regconfig
+        ELSE 'simple'::regconfig
+    END
+$$ LANGUAGE sql IMMUTABLE;
+
+-- dropping the column drops its index too
+ALTER TABLE posts DROP COLUMN tsvector_content;
+
+ALTER TABLE posts
+ADD COLUMN tsvector_content tsvector
+GENERATED ALWAYS AS (to_tsvector(language_ts_config(language), coalesce(title, '') || ' ' || coalesce(url, '') || ' ' || coalesce(body, ''))) STORED;
+
+CREATE INDEX idx_posts_tsvector_content ON posts USING GIN (tsvector_content);
+
+-- quick find matches titles and sites by trigram similarity, so typos and partial
+-- words still match. url_host is the site of the url without www.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE posts
+ADD COLUMN url_host TEXT
+GENERATED ALWAYS AS (regexp_replace(lower(substring(url from '://([^/?#:]+)')), '^www\.', '')) STORED;
+
+CREATE INDEX idx_posts_title_trgm ON posts USING GIN (title gin_trgm_ops);
+CREATE INDEX idx_posts_url_host_trgm ON posts USING GIN (url_host gin_trgm_ops);
+
+-- searches saved under a name, listed in the menu. state and length are the keys of
+-- the filters in search.go and length.go.
+CREATE TABLE saved_searches (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    query TEXT NOT NULL,
+    mode TEXT NOT NULL,
+    state TEXT NOT NULL,
+    length TEXT NOT NULL,
+    time_created BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (user_id, name)
+);
+
+-- when imported items were archived and liked in the service they came from, 0 if
+-- the export doesn't say
+ALTER TABLE import_items ADD COLUMN time_archived BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE import_items ADD COLUMN time_liked BIGINT NOT NULL DEFAULT 0;
+
+-- persisted query embeddings belong to the user who searched, so their searches are
+-- deleted with their account. Existing rows can't be attributed to anyone and are
+-- dropped, they're only a cache.
+DELETE FROM query_embeddings;
+ALTER TABLE query_embeddings ADD COLUMN user_id INTEGER NOT NULL;
+ALTER TABLE query_embeddings ADD FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE query_embeddings DROP CONSTRAINT query_embeddings_pkey;
+ALTER TABLE query_embeddings ADD PRIMARY KEY (user_id, model, query);
+
+-- import items which failed for a reason that may pass, like the node server not
+-- being up yet, are retried later: attempts counts the tries so far and retry_at is
+-- when the item can be claimed again, in unix seconds
+ALTER TABLE import_items ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE import_items ADD COLUMN retry_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,27 @@
+-- imports from other read-it-later services
+CREATE TABLE imports (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    format TEXT NOT NULL,
+    created_at BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- status is one of pending, processing, done, failed
+CREATE TABLE import_items (
+    id SERIAL PRIMARY KEY,
+    import_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
+    time_added BIGINT NOT NULL,
+    is_read BOOLEAN NOT NULL DEFAULT false,
+    is_liked BOOLEAN NOT NULL DEFAULT false,
+    status TEXT NOT NULL DEFAULT 'pending',
+    error TEXT NOT NULL DEFAULT '',
+    post_id INTEGER,
+    FOREIGN KEY (import_id) REFERENCES imports(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_import_items_import_id ON import_items (import_id);
+CREATE INDEX idx_import_items_pending ON import_items (id) WHERE status = 'pending';
@@ -0,0 +1,3 @@
+-- when posts were marked read and liked, for exports
+ALTER TABLE posts ADD COLUMN time_read BIGINT;
+ALTER TABLE posts ADD COLUMN time_liked BIGINT;
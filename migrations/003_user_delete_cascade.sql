@@ -0,0 +1,5 @@
+-- deleting a user deletes everything belonging to them
+ALTER TABLE posts DROP CONSTRAINT posts_user_id_fkey,
+    ADD CONSTRAINT posts_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE imports DROP CONSTRAINT imports_user_id_fkey,
+    ADD CONSTRAINT imports_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
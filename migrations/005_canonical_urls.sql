@@ -0,0 +1,7 @@
+-- normalized url used to detect posts which were already saved
+ALTER TABLE posts ADD COLUMN canonical_url TEXT;
+
+CREATE UNIQUE INDEX idx_posts_user_id_canonical_url ON posts (user_id, canonical_url);
+
+-- existing posts get their canonical url from the app, run afterwards:
+--   ./lucentsave backfill-canonical-urls
@@ -0,0 +1,6 @@
+-- article metadata found by the extractor, empty/null if the page didn't have it
+ALTER TABLE posts ADD COLUMN byline TEXT;
+ALTER TABLE posts ADD COLUMN site_name TEXT;
+ALTER TABLE posts ADD COLUMN excerpt TEXT;
+ALTER TABLE posts ADD COLUMN lead_image TEXT;
+ALTER TABLE posts ADD COLUMN time_published BIGINT;
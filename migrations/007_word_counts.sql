@@ -0,0 +1,5 @@
+-- number of words in the body, for reading time estimates and length filters
+ALTER TABLE posts ADD COLUMN word_count INTEGER;
+
+-- existing posts are counted by the app, run afterwards:
+--   ./lucentsave backfill-word-counts
@@ -0,0 +1,5 @@
+-- the post lists are paged by time_added, which has always been set on save
+UPDATE posts SET time_added = 0 WHERE time_added IS NULL;
+ALTER TABLE posts ALTER COLUMN time_added SET NOT NULL;
+
+CREATE INDEX idx_posts_user_id_is_read_time_added ON posts (user_id, is_read, time_added);
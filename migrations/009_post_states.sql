@@ -0,0 +1,16 @@
+-- posts move through inbox -> reading -> archived, and can be trashed from any of
+-- them. liked stays a separate flag. read posts become archived.
+ALTER TABLE posts ADD COLUMN state TEXT NOT NULL DEFAULT 'inbox'
+    CHECK (state IN ('inbox', 'reading', 'archived', 'trashed'));
+ALTER TABLE posts ADD COLUMN trashed_from TEXT;
+ALTER TABLE posts ADD COLUMN time_trashed BIGINT;
+
+UPDATE posts SET state = 'archived' WHERE is_read;
+
+ALTER TABLE posts RENAME COLUMN time_read TO time_archived;
+
+-- also drops the indexes on is_read
+ALTER TABLE posts DROP COLUMN is_read;
+
+CREATE INDEX idx_posts_user_id_state_time_added ON posts (user_id, state, time_added);
+CREATE INDEX idx_posts_time_trashed ON posts (time_trashed) WHERE state = 'trashed';
@@ -0,0 +1,3 @@
+-- how far the user has read a post, as a percentage and the block they were at
+ALTER TABLE posts ADD COLUMN read_progress REAL NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN progress_anchor TEXT;
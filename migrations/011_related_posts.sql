@@ -0,0 +1,6 @@
+-- related posts are cached on each post along with the library version they were
+-- computed at. the version is bumped whenever one of the user's posts gets a new
+-- embedding, which invalidates all of the user's cached related posts.
+ALTER TABLE users ADD COLUMN library_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN related_post_ids INTEGER[];
+ALTER TABLE posts ADD COLUMN related_version INTEGER;
@@ -0,0 +1,19 @@
+-- posts are grouped into topics by clustering their embeddings. topics_version is
+-- the library_version the topics were last computed at, and topics_post_count the
+-- number of posts at the last full clustering.
+CREATE TABLE topics (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    label TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    time_updated BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_topics_user_id ON topics (user_id);
+
+ALTER TABLE posts ADD COLUMN topic_id INTEGER REFERENCES topics(id) ON DELETE SET NULL;
+CREATE INDEX idx_posts_topic_id ON posts (topic_id);
+
+ALTER TABLE users ADD COLUMN topics_version INTEGER;
+ALTER TABLE users ADD COLUMN topics_post_count INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,11 @@
+-- summaries are opt in per user. posts are queued for summarizing by setting
+-- summary_status to pending, a background worker then fills in the summary.
+ALTER TABLE users ADD COLUMN summaries_enabled BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE posts ADD COLUMN summary_status TEXT
+    CHECK (summary_status IN ('pending', 'processing', 'done', 'failed'));
+ALTER TABLE posts ADD COLUMN summary_tldr TEXT;
+ALTER TABLE posts ADD COLUMN summary_points TEXT[];
+ALTER TABLE posts ADD COLUMN time_summarized BIGINT;
+
+CREATE INDEX idx_posts_summary_pending ON posts (id) WHERE summary_status = 'pending';
@@ -0,0 +1,29 @@
+-- search results are cached with an etag made from posts_version, which a trigger
+-- bumps whenever one of the user's posts is saved, deleted or changes in a way that
+-- shows in the results
+ALTER TABLE users ADD COLUMN posts_version BIGINT NOT NULL DEFAULT 0;
+
+CREATE FUNCTION bump_posts_version() RETURNS trigger AS $$
+BEGIN
+    UPDATE users SET posts_version = posts_version + 1
+    WHERE id = (CASE WHEN TG_OP = 'DELETE' THEN OLD.user_id ELSE NEW.user_id END);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER posts_version_insert_delete AFTER INSERT OR DELETE ON posts
+    FOR EACH ROW EXECUTE FUNCTION bump_posts_version();
+CREATE TRIGGER posts_version_update AFTER UPDATE OF url, title, state, is_liked, read_progress, byline,
+    site_name, excerpt, time_published, word_count, embedding ON posts
+    FOR EACH ROW EXECUTE FUNCTION bump_posts_version();
+
+-- embeddings of search queries, when the query cache is persisted (LS2_QUERY_CACHE_DB)
+CREATE TABLE query_embeddings (
+    model TEXT NOT NULL,
+    query TEXT NOT NULL,
+    embedding vector NOT NULL,
+    time_used BIGINT NOT NULL,
+    PRIMARY KEY (model, query)
+);
+
+CREATE INDEX idx_query_embeddings_time_used ON query_embeddings (time_used);
@@ -0,0 +1,9 @@
+-- tokens used embedding posts and queries, per user and day (UTC)
+CREATE TABLE embedding_usage (
+    user_id INTEGER NOT NULL,
+    day DATE NOT NULL,
+    tokens BIGINT NOT NULL DEFAULT 0,
+    requests INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, day),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,17 @@
+-- the model and dimensions of each post's embedding, and the ones search uses. While
+-- posts are re-embedded with another model, next_model and next_dimensions are set and
+-- the new embeddings go in posts.embedding_next, which the app adds and swaps in itself
+ALTER TABLE posts ADD COLUMN embedding_model TEXT, ADD COLUMN embedding_dimensions INTEGER;
+
+UPDATE posts SET embedding_model = 'text-embedding-3-small', embedding_dimensions = 1536
+WHERE embedding IS NOT NULL;
+
+CREATE TABLE embedding_config (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    model TEXT NOT NULL,
+    dimensions INTEGER NOT NULL,
+    next_model TEXT,
+    next_dimensions INTEGER
+);
+
+INSERT INTO embedding_config (model, dimensions) VALUES ('text-embedding-3-small', 1536);
@@ -0,0 +1,34 @@
+-- the language of each post as an ISO 639-1 code, detected when it's saved. '' if it
+-- couldn't be told, NULL for posts saved before detection existed until
+-- `lucentsave backfill-languages` is run
+ALTER TABLE posts ADD COLUMN language TEXT;
+
+-- the text search configuration posts in a language are indexed with, which has to
+-- agree with textSearchConfigs in language.go. Posts of unknown language aren't
+-- stemmed, posts not detected yet are indexed as English like before. Changing this
+-- doesn't reindex existing posts, the tsvector column has to be added again for that
+CREATE FUNCTION language_ts_config(language TEXT) RETURNS regconfig AS $$
+    SELECT CASE coalesce(language, 'en')
+        WHEN 'en' THEN 'english'::regconfig
+        WHEN 'de' THEN 'german'::regconfig
+        WHEN 'fr' THEN 'french'::regconfig
+        WHEN 'es' THEN 'spanish'::regconfig
+        WHEN 'it' THEN 'italian'::regconfig
+        WHEN 'pt' THEN 'portuguese'::regconfig
+        WHEN 'nl' THEN 'dutch'::regconfig
+        WHEN 'sv' THEN 'swedish'::regconfig
+        WHEN 'da' THEN 'danish'::regconfig
+        WHEN 'fi' THEN 'finnish'::regconfig
+        WHEN 'ru' THEN 'russian'::regconfig
+        ELSE 'simple'::regconfig
+    END
+$$ LANGUAGE sql IMMUTABLE;
+
+-- dropping the column drops its index too
+ALTER TABLE posts DROP COLUMN tsvector_content;
+
+ALTER TABLE posts
+ADD COLUMN tsvector_content tsvector
+GENERATED ALWAYS AS (to_tsvector(language_ts_config(language), coalesce(title, '') || ' ' || coalesce(url, '') || ' ' || coalesce(body, ''))) STORED;
+
+CREATE INDEX idx_posts_tsvector_content ON posts USING GIN (tsvector_content);
@@ -0,0 +1,10 @@
+-- quick find matches titles and sites by trigram similarity, so typos and partial
+-- words still match. url_host is the site of the url without www.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE posts
+ADD COLUMN url_host TEXT
+GENERATED ALWAYS AS (regexp_replace(lower(substring(url from '://([^/?#:]+)')), '^www\.', '')) STORED;
+
+CREATE INDEX idx_posts_title_trgm ON posts USING GIN (title gin_trgm_ops);
+CREATE INDEX idx_posts_url_host_trgm ON posts USING GIN (url_host gin_trgm_ops);
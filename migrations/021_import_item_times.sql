@@ -0,0 +1,4 @@
+-- when imported items were archived and liked in the service they came from, 0 if
+-- the export doesn't say
+ALTER TABLE import_items ADD COLUMN time_archived BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE import_items ADD COLUMN time_liked BIGINT NOT NULL DEFAULT 0;
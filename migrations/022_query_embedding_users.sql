@@ -0,0 +1,8 @@
+-- persisted query embeddings belong to the user who searched, so their searches are
+-- deleted with their account. Existing rows can't be attributed to anyone and are
+-- dropped, they're only a cache.
+DELETE FROM query_embeddings;
+ALTER TABLE query_embeddings ADD COLUMN user_id INTEGER NOT NULL;
+ALTER TABLE query_embeddings ADD FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE query_embeddings DROP CONSTRAINT query_embeddings_pkey;
+ALTER TABLE query_embeddings ADD PRIMARY KEY (user_id, model, query);
@@ -0,0 +1,5 @@
+-- import items which failed for a reason that may pass, like the node server not
+-- being up yet, are retried later: attempts counts the tries so far and retry_at is
+-- when the item can be claimed again, in unix seconds
+ALTER TABLE import_items ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE import_items ADD COLUMN retry_at BIGINT NOT NULL DEFAULT 0;
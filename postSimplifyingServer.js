@@ -4,6 +4,57 @@ import { JSDOM } from 'jsdom';
 import fetch from 'node-fetch';
 import createDOMPurify from 'dompurify';
 
+// getMetadata reads article metadata from OpenGraph/meta tags and JSON-LD, used
+// where readability doesn't find something itself
+function getMetadata(document, url) {
+    const meta = (...names) => {
+        for (const name of names) {
+            const el = document.querySelector(`meta[property="${name}"], meta[name="${name}"]`);
+            if (el && el.content && el.content.trim()) {
+                return el.content.trim();
+            }
+        }
+        return '';
+    };
+
+    // first JSON-LD object which looks like an article, they may be nested in lists or @graph
+    let ld = {};
+    for (const script of document.querySelectorAll('script[type="application/ld+json"]')) {
+        try {
+            const data = JSON.parse(script.textContent);
+            const candidates = [].concat(data).flatMap(d => d && d['@graph'] ? d['@graph'] : [d]);
+            const article = candidates.find(d => d && [].concat(d['@type']).some(t => /Article|Posting|Report/.test(t)));
+            if (article) {
+                ld = article;
+                break;
+            }
+        } catch (e) {
+            // lots of sites have broken JSON-LD, just ignore it
+        }
+    }
+
+    const name = v => [].concat(v || []).map(x => typeof x === 'string' ? x : x && x.name).filter(Boolean).join(', ');
+    const imageURL = v => {
+        const first = [].concat(v || [])[0];
+        return typeof first === 'string' ? first : (first && first.url) || '';
+    };
+    const absolute = href => {
+        try {
+            return href ? new URL(href, url).href : '';
+        } catch (e) {
+            return '';
+        }
+    };
+
+    return {
+        byline: name(ld.author) || meta('author', 'article:author', 'parsely-author'),
+        publishedTime: ld.datePublished || meta('article:published_time', 'datePublished', 'date', 'parsely-pub-date'),
+        siteName: meta('og:site_name', 'application-name') || name(ld.publisher),
+        excerpt: meta('og:description', 'description', 'twitter:description') || ld.description || '',
+        leadImage: absolute(meta('og:image', 'og:image:url', 'twitter:image') || imageURL(ld.image)),
+    };
+}
+
 const app = express();
 app.use(express.json());
 
@@ -22,6 +73,12 @@ app.post('/process', async (req, res) => {
         // Create a new JSDOM instance
         const dom = new JSDOM(html, { url });
 
+        // read before readability runs, since it modifies the document. jsdom resolves
+        // the href against the page url for us
+        const canonicalLink = dom.window.document.querySelector('link[rel="canonical"]');
+        const canonicalUrl = canonicalLink ? canonicalLink.href : '';
+        const metadata = getMetadata(dom.window.document, url);
+
         // Use Readability to parse the document
         const reader = new Readability(dom.window.document);
         let article = reader.parse();
@@ -39,7 +96,13 @@ app.post('/process', async (req, res) => {
         res.json({
             title: article.title,
             content: sanitizedContent,
-            url: url
+            url: url,
+            canonicalUrl: canonicalUrl,
+            byline: article.byline || metadata.byline,
+            publishedTime: article.publishedTime || metadata.publishedTime,
+            siteName: article.siteName || metadata.siteName,
+            excerpt: article.excerpt || metadata.excerpt,
+            leadImage: metadata.leadImage
         });
     } catch (error) {
         console.error('Error processing URL:', error);
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+	"golang.org/x/net/html"
+)
+
+// Ask mode answers a question from the user's library. The posts nearest to the
+// question are found with the embedding index and split into passages at block
+// boundaries. The passages best matching the question's words are embedded too, and
+// the ones nearest to the question are sent to a chat model, which answers citing
+// them by number. Each passage is anchored at its first block the same way reading
+// progress is, so citations can link right to it.
+
+// ChatProvider streams replies from a chat model.
+type ChatProvider interface {
+	// StreamChat calls onDelta with each piece of the reply as it arrives.
+	StreamChat(ctx context.Context, messages []ChatMessage, onDelta func(string) error) error
+}
+
+type ChatMessage struct {
+	Role    string // system, user or assistant
+	Content string
+}
+
+var chatProvider ChatProvider
+
+const defaultChatModel = "gpt-4o-mini"
+
+// initChatProvider sets up answering with the OpenAI client used for embeddings, or
+// with a separate OpenAI compatible endpoint if LS2_CHAT_BASE_URL is set.
+func initChatProvider() {
+	chatClient := client
+	if baseURL := os.Getenv("LS2_CHAT_BASE_URL"); baseURL != "" {
+		chatClient = newOpenAIClient(os.Getenv("LS2_CHAT_API_KEY"), baseURL)
+	}
+
+	model := os.Getenv("LS2_CHAT_MODEL")
+	if model == "" {
+		model = defaultChatModel
+	}
+
+	chatProvider = openAIChatProvider{client: chatClient, model: model}
+}
+
+type openAIChatProvider struct {
+	client *openai.Client
+	model  string
+}
+
+func (p openAIChatProvider) StreamChat(ctx context.Context, messages []ChatMessage, onDelta func(string) error) error {
+	req := openai.ChatCompletionRequest{Model: p.model, Temperature: 0.2, Stream: true}
+	for _, m := range messages {
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{Role: m.Role, Content: m.Content})
+	}
+
+	stream, err := p.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return fmt.Errorf("failed to start chat completion: %w", err)
+	}
+	defer stream.Close()
+
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read chat completion: %w", err)
+		}
+
+		if len(resp.Choices) > 0 && resp.Choices[0].Delta.Content != "" {
+			if err := onDelta(resp.Choices[0].Delta.Content); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+const (
+	maxQuestionLength = 500
+	askPosts          = 5
+	askPassages       = 8
+	// at most this many passages, the best by the question's terms, are embedded to
+	// rank them, so a long article doesn't make every question cost its whole text
+	askEmbeddedPassages = 24
+	askPassagesPerPost  = 3
+	maxPassageChars     = 1200
+)
+
+// Passage is a run of consecutive blocks of an article. Anchor is the tag and index
+// of its first block among the blocks matched by the selector in postView.html.
+type Passage struct {
+	Anchor string
+	Text   string
+}
+
+// AskSource is a passage given to the model, numbered as it's cited.
+type AskSource struct {
+	N      int    `json:"n"`
+	PostID int    `json:"postID"`
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	Text   string `json:"-"`
+}
+
+// passageBlocks are the tags of the block selector in postView.html, which anchors
+// have to agree with.
+var passageBlocks = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"li": true, "pre": true, "blockquote": true, "figure": true, "table": true,
+}
+
+// articlePassages splits a post body into passages of up to about maxPassageChars,
+// starting new passages at headings.
+func articlePassages(body string) []Passage {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	type block struct {
+		anchor string
+		tag    string
+		text   string
+	}
+	var blocks []block
+	index := 0
+
+	// blocks nested in another block are counted, since querySelectorAll counts them,
+	// but their text is already part of the outer block
+	var walk func(n *html.Node, inBlock bool)
+	walk = func(n *html.Node, inBlock bool) {
+		if n.Type == html.ElementNode && passageBlocks[n.Data] {
+			if !inBlock {
+				text := strings.Join(strings.Fields(nodeText(n)), " ")
+				if text != "" {
+					blocks = append(blocks, block{fmt.Sprintf("%v:%v", n.Data, index), n.Data, text})
+				}
+			}
+			index++
+			inBlock = true
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, inBlock)
+		}
+	}
+	walk(doc, false)
+
+	var passages []Passage
+	for _, b := range blocks {
+		heading := len(b.tag) == 2 && b.tag[0] == 'h'
+		if len(passages) == 0 || heading || len(passages[len(passages)-1].Text)+len(b.text) > maxPassageChars {
+			passages = append(passages, Passage{Anchor: b.anchor, Text: truncateText(b.text, maxPassageChars)})
+			continue
+		}
+		passages[len(passages)-1].Text += "\n" + b.text
+	}
+	return passages
+}
+
+// askCandidate is a passage of one of the posts nearest to a question.
+type askCandidate struct {
+	post    ScoredPost
+	passage Passage
+	score   float64
+}
+
+func askCandidates(posts []ScoredPost) []askCandidate {
+	var candidates []askCandidate
+	for _, post := range posts {
+		for _, passage := range articlePassages(post.Body) {
+			candidates = append(candidates, askCandidate{post: post, passage: passage})
+		}
+	}
+	return candidates
+}
+
+// scorePassagesByEmbedding scores each candidate by the cosine similarity of its
+// passage's embedding to the question's, so passages saying the same thing in other
+// words still match.
+func scorePassagesByEmbedding(candidates []askCandidate, questionEmbedding []float32, embeddings [][]float32) {
+	question := slices.Clone(questionEmbedding)
+	normalize(question)
+	for i := range candidates {
+		normalize(embeddings[i])
+		candidates[i].score = float64(dot(question, embeddings[i]))
+	}
+}
+
+// scorePassagesByTerms scores each candidate by the terms of the question its passage
+// contains, weighted by how rare the term is among all the passages, plus the
+// similarity of its post to the question. It picks the passages worth embedding, and
+// ranks them when they can't be embedded.
+func scorePassagesByTerms(candidates []askCandidate, question string) {
+	terms := make([]map[string]bool, len(candidates))
+	docFreq := map[string]int{}
+	for i, c := range candidates {
+		terms[i] = textTerms(c.passage.Text)
+		for term := range terms[i] {
+			docFreq[term]++
+		}
+	}
+
+	questionTerms := textTerms(question)
+	for i := range candidates {
+		for term := range questionTerms {
+			if terms[i][term] {
+				candidates[i].score += math.Log(1 + float64(len(candidates))/float64(docFreq[term]))
+			}
+		}
+		candidates[i].score += 2 * candidates[i].post.Similarity
+	}
+}
+
+// pickPassages returns the best scoring passages, at most askPassagesPerPost from a post.
+func pickPassages(candidates []askCandidate) []AskSource {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	var sources []AskSource
+	perPost := map[int]int{}
+	for _, c := range candidates {
+		if len(sources) == askPassages {
+			break
+		}
+		if perPost[c.post.ID] == askPassagesPerPost {
+			continue
+		}
+		perPost[c.post.ID]++
+		sources = append(sources, AskSource{
+			N:      len(sources) + 1,
+			PostID: c.post.ID,
+			Title:  c.post.Title,
+			URL:    fmt.Sprintf("/post?id=%v#passage=%v", c.post.ID, c.passage.Anchor),
+			Text:   c.passage.Text,
+		})
+	}
+	return sources
+}
+
+const askPrompt = `You answer questions using passages from articles the user has saved. ` +
+	`Use only the passages below. Cite the passages you use with their number in square brackets, like [2], ` +
+	`right after the statement they support. If the passages don't answer the question, say so briefly. ` +
+	`Answer in the language of the question.`
+
+// askMessages builds the messages sent to the chat model for a question.
+func askMessages(question string, sources []AskSource) []ChatMessage {
+	var sb strings.Builder
+	sb.WriteString(askPrompt + "\n\n")
+	for _, source := range sources {
+		fmt.Fprintf(&sb, "[%v] From \"%v\":\n%v\n\n", source.N, source.Title, source.Text)
+	}
+
+	return []ChatMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: sb.String()},
+		{Role: openai.ChatMessageRoleUser, Content: question},
+	}
+}
+
+// findAskSources returns the passages to answer a question from. The passages of the
+// nearest posts best matching the question's terms are embedded to rank them, which
+// counts towards the user's usage.
+func findAskSources(userID int, question string) ([]AskSource, error) {
+	// the question and passages are embedded in the same space even if search is cut
+	// over to another one meanwhile
+	space := currentEmbeddingSpace()
+	embedding, err := getQueryEmbedding(userID, space, question)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := getAskCandidatePosts(userID, embedding, askPosts)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := askCandidates(posts)
+	scorePassagesByTerms(candidates, question)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	candidates = candidates[:min(len(candidates), askEmbeddedPassages)]
+
+	texts := make([]string, len(candidates))
+	for i, c := range candidates {
+		texts[i] = c.passage.Text
+	}
+
+	passageEmbeddings, err := embedTexts(userID, space, texts)
+	if errors.Is(err, errEmbeddingQuotaExceeded) {
+		return nil, err
+	} else if err != nil {
+		// they're still ranked by terms
+		slog.Warn("failed to embed passages, ranking them by terms", "userID", userID, "error", err)
+	} else {
+		scorePassagesByEmbedding(candidates, embedding, passageEmbeddings)
+	}
+
+	return pickPassages(candidates), nil
+}
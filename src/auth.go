@@ -42,6 +42,19 @@ func generateAndSetAuthToken(w http.ResponseWriter, userID int) error {
 	return nil
 }
 
+func clearAuthToken(w http.ResponseWriter) {
+	// Clear the auth cookie by setting it to expire immediately
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    "",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		HttpOnly: true,
+		Secure:   os.Getenv("ENV") == "production",
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+}
+
 func getRequestToken(r *http.Request) (*jwt.Token, error) {
 	c, err := r.Cookie("token")
 	if err != nil {
@@ -66,6 +79,8 @@ type key int
 
 const (
 	userIDKey key = iota
+	csrfTokenKey
+	cspNonceKey
 )
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -87,6 +102,19 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		// tokens can't be revoked, so check that the account wasn't deleted since it was issued
+		exists, err := checkUserIdExists(claims.UserID)
+		if err != nil {
+			logAndRespondInternalError(slog.Default(), "failed to check user exists", w, err)
+			return
+		}
+		if !exists {
+			slog.Warn("token for deleted user", "userID", claims.UserID)
+			clearAuthToken(w)
+			http.Redirect(w, r, "/signin", http.StatusTemporaryRedirect)
+			return
+		}
+
 		// Refresh the token expiration
 		if err := generateAndSetAuthToken(w, claims.UserID); err != nil {
 			logAndRespondInternalError(slog.Default(), "failed to refresh token", w, err)
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// canonicalizeURL normalizes a url so that different links to the same article
+// compare equal: the scheme and host are lowercased, default ports, fragments and
+// tracking parameters are dropped. Urls which don't parse are returned as is.
+func canonicalizeURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return raw
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && u.Port() == "80") || (u.Scheme == "https" && u.Port() == "443") {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	stripTrackingParams(u)
+	u.ForceQuery = false
+
+	return u.String()
+}
+
+// canonicalURLForArticle picks the canonical url for an extracted article, preferring
+// the page's <link rel=canonical> if it has a usable one. Many sites point every
+// page's canonical at their home page, and a post with the same canonical url as
+// another isn't saved, so only canonicals on the post's own host which aren't its
+// root are used.
+func canonicalURLForArticle(postURL string, article Article) string {
+	if article.CanonicalURL != "" && isUrl(article.CanonicalURL) {
+		u, err := url.Parse(article.CanonicalURL)
+		post, postErr := url.Parse(postURL)
+		if err == nil && postErr == nil && (u.Scheme == "http" || u.Scheme == "https") &&
+			strings.EqualFold(u.Hostname(), post.Hostname()) && u.Path != "" && u.Path != "/" {
+			return canonicalizeURL(article.CanonicalURL)
+		}
+	}
+	return canonicalizeURL(postURL)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// Text longer than an embedding model takes is split into chunks which are embedded
+// separately. Chunks end at sentence boundaries, preferably at the end of a paragraph.
+// When a chunk starts in the middle of a paragraph it repeats the paragraph's last
+// sentences from the chunk before, so they don't lose their context. Sizes are in
+// tokens as counted by the model's tokenizer.
+
+const (
+	defaultChunkTokens        = 2048
+	defaultChunkOverlapTokens = 128
+	// the input limit of OpenAI's embedding models
+	maxChunkTokens = 8191
+)
+
+// Tokenizer counts the tokens a model splits text into.
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+type tiktokenTokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+func (t tiktokenTokenizer) CountTokens(text string) int {
+	return len(t.encoding.EncodeOrdinary(text))
+}
+
+// estimatingTokenizer is used for models without a known tokenizer.
+type estimatingTokenizer struct{}
+
+func (estimatingTokenizer) CountTokens(text string) int {
+	return estimateTokens(text)
+}
+
+// the longest we wait for a tokenizer's vocabulary to download
+const tokenizerLoadTimeout = 30 * time.Second
+
+var (
+	tokenizersMu sync.Mutex
+	tokenizers   = map[string]Tokenizer{}
+	// models whose tokenizer is being loaded, or failed to
+	tokenizersLoading = map[string]bool{}
+)
+
+func init() {
+	tiktoken.SetBpeLoader(bpeLoader{client: &http.Client{Timeout: tokenizerLoadTimeout}})
+}
+
+// tokenizerForModel returns the tokenizer of an embedding model. Its vocabulary is
+// downloaded in the background the first time, and token counts are estimated until
+// it's there, or for good if the download fails.
+func tokenizerForModel(model string) Tokenizer {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+
+	if tokenizer, ok := tokenizers[model]; ok {
+		return tokenizer
+	}
+	if !tokenizersLoading[model] {
+		tokenizersLoading[model] = true
+		go loadTokenizer(model)
+	}
+	return estimatingTokenizer{}
+}
+
+// loadTokenizer loads a model's tokenizer for tokenizerForModel. main starts it for
+// the embedding models in use, so the vocabulary is usually there before it's needed.
+func loadTokenizer(model string) {
+	encoding, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		slog.Warn("no tokenizer for embedding model, estimating token counts", "model", model, "error", err)
+		return
+	}
+
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	tokenizers[model] = tiktokenTokenizer{encoding}
+}
+
+// bpeLoader loads tokenizer vocabularies like tiktoken's default loader, cached in
+// TIKTOKEN_CACHE_DIR, but with a timeout on the download.
+type bpeLoader struct {
+	client *http.Client
+}
+
+func (l bpeLoader) LoadTiktokenBpe(file string) (map[string]int, error) {
+	contents, err := l.readCached(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ranks := map[string]int{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" {
+			continue
+		}
+		encoded, rankStr, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid vocabulary line %q", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		rank, err := strconv.Atoi(rankStr)
+		if err != nil {
+			return nil, err
+		}
+		ranks[string(token)] = rank
+	}
+	return ranks, nil
+}
+
+func (l bpeLoader) readCached(file string) ([]byte, error) {
+	cacheDir := os.Getenv("TIKTOKEN_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "data-gym-cache")
+	}
+	// the same name tiktoken's own loader uses, so either finds what the other cached
+	cachePath := filepath.Join(cacheDir, fmt.Sprintf("%x", sha1.Sum([]byte(file))))
+	if contents, err := os.ReadFile(cachePath); err == nil {
+		return contents, nil
+	}
+
+	resp, err := l.client.Get(file)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %v: %v", file, resp.Status)
+	}
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(cachePath, contents); err != nil {
+		slog.Warn("failed to cache tokenizer vocabulary", "path", cachePath, "error", err)
+	}
+	return contents, nil
+}
+
+// writeFileAtomic writes a file through a temporary one, so readers never see part of it.
+func writeFileAtomic(path string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// chunker splits text into chunks of at most maxTokens tokens, each starting with up
+// to overlapTokens tokens from the end of the chunk before it.
+type chunker struct {
+	tokenizer     Tokenizer
+	maxTokens     int
+	overlapTokens int
+}
+
+// chunkerForSpace returns the chunker for embedding text in the space, sized by
+// LS2_EMBEDDING_CHUNK_TOKENS and LS2_EMBEDDING_CHUNK_OVERLAP.
+func chunkerForSpace(space embeddingSpace) chunker {
+	maxTokens := envInt("LS2_EMBEDDING_CHUNK_TOKENS", defaultChunkTokens)
+	maxTokens = max(16, min(maxTokens, maxChunkTokens))
+
+	overlapTokens := envInt("LS2_EMBEDDING_CHUNK_OVERLAP", defaultChunkOverlapTokens)
+	overlapTokens = min(overlapTokens, maxTokens/2)
+
+	return chunker{tokenizer: tokenizerForModel(space.Model), maxTokens: maxTokens, overlapTokens: overlapTokens}
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// textUnit is a piece of text which chunks don't split, with the whitespace after it.
+type textUnit struct {
+	text   string
+	tokens int
+	// whether a paragraph ends with this unit
+	paragraphEnd bool
+}
+
+// split returns the chunks of the text. Invalid UTF-8 is replaced, so every chunk is
+// valid UTF-8.
+func (c chunker) split(text string) []string {
+	units := c.units(strings.ToValidUTF8(text, "�"))
+
+	var chunks []string
+	start, prevEnd := 0, 0
+	for start < len(units) {
+		end, tokens := start, 0
+		for end < len(units) && tokens+units[end].tokens <= c.maxTokens {
+			tokens += units[end].tokens
+			end++
+		}
+
+		// end at a paragraph instead if that still leaves the chunk half full and the
+		// chunk gets past the previous one
+		if end < len(units) {
+			kept := tokens
+			for i := end; i >= max(start+1, prevEnd+1); i-- {
+				if units[i-1].paragraphEnd && kept >= tokens/2 {
+					end = i
+					break
+				}
+				kept -= units[i-1].tokens
+			}
+		}
+
+		if chunk := strings.TrimSpace(joinUnits(units[start:end])); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		if end == len(units) {
+			break
+		}
+
+		// the next chunk starts with the sentences of this one's last overlapTokens
+		// which fit before the unit this one ended at
+		next, overlap := end, 0
+		for next > start+1 && !units[next-1].paragraphEnd &&
+			overlap+units[next-1].tokens+units[end].tokens <= c.maxTokens &&
+			overlap+units[next-1].tokens <= c.overlapTokens {
+			next--
+			overlap += units[next].tokens
+		}
+		start, prevEnd = next, end
+	}
+
+	return chunks
+}
+
+func joinUnits(units []textUnit) string {
+	var sb strings.Builder
+	for _, u := range units {
+		sb.WriteString(u.text)
+	}
+	return sb.String()
+}
+
+// units splits the text into sentences, and sentences which are too long for a chunk
+// into words or, failing that, pieces of words.
+func (c chunker) units(text string) []textUnit {
+	var units []textUnit
+	for _, sentence := range splitSentences(text) {
+		tokens := c.tokenizer.CountTokens(sentence.text)
+		if tokens <= c.maxTokens {
+			sentence.tokens = tokens
+			units = append(units, sentence)
+			continue
+		}
+
+		words := splitAfterSpaces(sentence.text)
+		for i, word := range words {
+			pieces := []string{word}
+			if c.tokenizer.CountTokens(word) > c.maxTokens {
+				pieces = splitRunes(word, c.maxTokens)
+			}
+			for _, piece := range pieces {
+				units = append(units, textUnit{text: piece, tokens: c.tokenizer.CountTokens(piece)})
+			}
+			if i == len(words)-1 {
+				units[len(units)-1].paragraphEnd = sentence.paragraphEnd
+			}
+		}
+	}
+	return units
+}
+
+// splitSentences splits text after the whitespace following the end of each sentence
+// and line, so the sentences joined are the text.
+func splitSentences(text string) []textUnit {
+	var units []textUnit
+	start := 0
+	ended := false // whether the text up to i ends a sentence, before whitespace
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r == '\n' || (unicode.IsSpace(r) && ended):
+			// take the whole run of whitespace
+			j := i
+			for j < len(text) {
+				r, size := utf8.DecodeRuneInString(text[j:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				j += size
+			}
+			units = append(units, textUnit{text: text[start:j], paragraphEnd: strings.Count(text[i:j], "\n") >= 2})
+			start, i, ended = j, j, false
+			continue
+		case strings.ContainsRune(".!?…。！？", r):
+			ended = true
+		case ended && strings.ContainsRune(`"')]»”’`, r):
+			// closing quotes and brackets belong to the sentence they end
+		default:
+			ended = false
+		}
+		i += size
+	}
+
+	if start < len(text) {
+		units = append(units, textUnit{text: text[start:], paragraphEnd: true})
+	} else if len(units) > 0 {
+		units[len(units)-1].paragraphEnd = true
+	}
+	return units
+}
+
+// splitAfterSpaces splits text after each run of whitespace.
+func splitAfterSpaces(text string) []string {
+	var words []string
+	start := 0
+	inSpace := false
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			inSpace = true
+		} else if inSpace {
+			words = append(words, text[start:i])
+			start, inSpace = i, false
+		}
+	}
+	if start < len(text) {
+		words = append(words, text[start:])
+	}
+	return words
+}
+
+// splitRunes splits text into pieces of at most maxBytes bytes without cutting runes.
+// No tokenizer makes more tokens than bytes, so the pieces have at most maxBytes tokens.
+func splitRunes(text string, maxBytes int) []string {
+	var pieces []string
+	for len(text) > maxBytes {
+		end := maxBytes
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		if end == 0 {
+			// a rune longer than maxBytes, which can't happen for maxBytes >= 4
+			_, end = utf8.DecodeRuneInString(text)
+		}
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+	return append(pieces, text)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// wordTokenizer counts one token per word, so expected chunks are easy to work out.
+type wordTokenizer struct{}
+
+func (wordTokenizer) CountTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+// runeTokenizer counts one token per non-space rune, like tokenizers roughly do for
+// Chinese and Japanese.
+type runeTokenizer struct{}
+
+func (runeTokenizer) CountTokens(text string) int {
+	n := 0
+	for _, r := range text {
+		if !unicode.IsSpace(r) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestChunkerSplit(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokenizer Tokenizer
+		maxTokens int
+		overlap   int
+		text      string
+		want      []string
+	}{
+		{
+			name:      "empty",
+			tokenizer: wordTokenizer{},
+			maxTokens: 10,
+			text:      "",
+			want:      nil,
+		},
+		{
+			name:      "only whitespace",
+			tokenizer: wordTokenizer{},
+			maxTokens: 10,
+			text:      " \n\n \t",
+			want:      nil,
+		},
+		{
+			name:      "fits in one chunk",
+			tokenizer: wordTokenizer{},
+			maxTokens: 10,
+			text:      "One two three. Four five.",
+			want:      []string{"One two three. Four five."},
+		},
+		{
+			name:      "ends chunks at sentences",
+			tokenizer: wordTokenizer{},
+			maxTokens: 5,
+			text:      "One two three. Four five six. Seven eight.",
+			want:      []string{"One two three.", "Four five six. Seven eight."},
+		},
+		{
+			name:      "prefers ending at a paragraph",
+			tokenizer: wordTokenizer{},
+			maxTokens: 6,
+			text:      "A b c. D e f.\n\nG h. I j. K l.",
+			want:      []string{"A b c. D e f.", "G h. I j. K l."},
+		},
+		{
+			name:      "repeats sentences of a split paragraph",
+			tokenizer: wordTokenizer{},
+			maxTokens: 4,
+			overlap:   2,
+			text:      "A b. C d. E f.",
+			want:      []string{"A b. C d.", "C d. E f."},
+		},
+		{
+			name:      "doesn't overlap across paragraphs",
+			tokenizer: wordTokenizer{},
+			maxTokens: 4,
+			overlap:   2,
+			text:      "A b. C d.\n\nE f. G h.",
+			want:      []string{"A b. C d.", "E f. G h."},
+		},
+		{
+			name:      "sentence longer than the limit is split into words",
+			tokenizer: wordTokenizer{},
+			maxTokens: 3,
+			text:      "one two three four five six seven",
+			want:      []string{"one two three", "four five six", "seven"},
+		},
+		{
+			name:      "word longer than the limit is split into pieces",
+			tokenizer: runeTokenizer{},
+			maxTokens: 4,
+			text:      "abcdefghij",
+			want:      []string{"abcd", "efgh", "ij"},
+		},
+		{
+			name:      "cjk without spaces",
+			tokenizer: runeTokenizer{},
+			maxTokens: 6,
+			text:      "東京は日本の首都です。大阪は大きい。",
+			// there are no spaces after the full stops, so it's one sentence which is cut
+			// into pieces of maxTokens bytes, two runes, and those are put into chunks
+			want: []string{"東京は日本の", "首都です。大", "阪は大きい。"},
+		},
+		{
+			name:      "invalid utf-8 is replaced",
+			tokenizer: wordTokenizer{},
+			maxTokens: 10,
+			text:      "bad \xff byte",
+			want:      []string{"bad � byte"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := chunker{tokenizer: tt.tokenizer, maxTokens: tt.maxTokens, overlapTokens: tt.overlap}
+			got := c.split(tt.text)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("split(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestChunkerLimits checks that no chunk is over the limit and that the chunks cover
+// all of the text, in order, for texts and limits which don't divide evenly.
+func TestChunkerLimits(t *testing.T) {
+	// the sentences are numbered so that the texts aren't one paragraph over and over
+	paragraphs := func(n int, format string, sep string) string {
+		var sb strings.Builder
+		for i := range n {
+			fmt.Fprintf(&sb, format, i)
+			sb.WriteString(sep)
+		}
+		return sb.String()
+	}
+	paragraph := "The quick brown fox %[1]v jumps over the lazy dog. It wasn't amused %[1]v times! Was the dog asleep? " +
+		"Nobody knows, but the fox %[1]v has been seen again since… \"Really.\" (Yes.)"
+	texts := []string{
+		paragraphs(20, paragraph, "\n\n"),
+		paragraphs(20, paragraph, " "),
+		paragraphs(50, "東京は%[1]v日本の%[1]v首都です%[1]v。", ""),
+		// a word over the limit, "0123456789101112…", so its pieces don't repeat
+		paragraphs(400, "%v", "")[:1000] + " " + paragraphs(1, paragraph, ""),
+		"# Heading\n\n- item one\n- item two\n\n" + paragraphs(10, paragraph, "\n"),
+	}
+	tokenizers := map[string]Tokenizer{"words": wordTokenizer{}, "runes": runeTokenizer{}, "estimate": estimatingTokenizer{}}
+
+	for name, tokenizer := range tokenizers {
+		for _, maxTokens := range []int{16, 37, 100, 512} {
+			for _, overlap := range []int{0, 5, maxTokens / 2} {
+				c := chunker{tokenizer: tokenizer, maxTokens: maxTokens, overlapTokens: overlap}
+				for i, text := range texts {
+					chunks := c.split(text)
+					if len(chunks) == 0 {
+						t.Fatalf("%v max %v overlap %v text %v: no chunks", name, maxTokens, overlap, i)
+					}
+
+					whole := stripSpace(text)
+					start, pos := 0, 0
+					for j, chunk := range chunks {
+						if n := tokenizer.CountTokens(chunk); n > maxTokens {
+							t.Errorf("%v max %v overlap %v text %v: chunk %v has %v tokens", name, maxTokens, overlap, i, j, n)
+						}
+						if !utf8.ValidString(chunk) {
+							t.Errorf("%v max %v overlap %v text %v: chunk %v isn't valid utf-8", name, maxTokens, overlap, i, j)
+						}
+
+						// each chunk starts at or before where the last one ended, and goes past it.
+						// Some sentences repeat, so the chunk is taken to be at the last such place
+						// after the last chunk's start.
+						stripped := stripSpace(chunk)
+						found := -1
+						for at := start; at <= pos; at++ {
+							if strings.HasPrefix(whole[at:], stripped) && at+len(stripped) > pos {
+								found = at
+							}
+						}
+						if found == -1 {
+							t.Fatalf("%v max %v overlap %v text %v: chunk %v doesn't carry on from chunk %v", name, maxTokens, overlap, i, j, j-1)
+						}
+						start = found
+						pos = start + len(stripped)
+					}
+					if pos != len(whole) {
+						t.Errorf("%v max %v overlap %v text %v: chunks end at %v of %v", name, maxTokens, overlap, i, pos, len(whole))
+					}
+				}
+			}
+		}
+	}
+}
+
+func stripSpace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
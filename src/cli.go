@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand runs a one-off admin command against the database instead of starting the server.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "import":
+		return runImportCommand(args)
+	case "export":
+		return runExportCommand(args)
+	case "backfill-canonical-urls":
+		initDatabase()
+		updated, duplicates, err := backfillCanonicalURLs()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("set canonical url for %v posts, skipped %v duplicates\n", updated, duplicates)
+		return nil
+	case "backfill-word-counts":
+		initDatabase()
+		updated, err := backfillWordCounts()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("set word count for %v posts\n", updated)
+		return nil
+	case "backfill-languages":
+		initDatabase()
+		updated, err := backfillLanguages()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("detected language of %v posts\n", updated)
+		return nil
+	case "embedding-usage":
+		return runEmbeddingUsageCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// runImportCommand queues an export file for import. The items are extracted by the
+// import worker of the running server, the same as uploads through /import.
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	email := fs.String("email", "", "email of the user to import posts for")
+	path := fs.String("file", "", "path to the export file")
+	fs.Parse(args)
+
+	if *email == "" || *path == "" {
+		fs.Usage()
+		return fmt.Errorf("both -email and -file are required")
+	}
+
+	data, err := os.ReadFile(*path)
+	if err != nil {
+		return err
+	}
+
+	items, format, err := parseImportFile(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse %v: %w", *path, err)
+	}
+
+	initDatabase()
+
+	userID, err := getUserIdByEmail(*email)
+	if err != nil {
+		return fmt.Errorf("no user with email %v: %w", *email, err)
+	}
+
+	importID, err := createImport(userID, format, items)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("queued %v posts from %v file, track progress at /import?id=%v\n", len(items), format, importID)
+	return nil
+}
+
+// runExportCommand writes the same zip as the /export download to a file.
+func runExportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	email := fs.String("email", "", "email of the user to export")
+	out := fs.String("out", exportFileName(), "path of the zip file to write")
+	fs.Parse(args)
+
+	if *email == "" {
+		fs.Usage()
+		return fmt.Errorf("-email is required")
+	}
+
+	initDatabase()
+
+	userID, err := getUserIdByEmail(*email)
+	if err != nil {
+		return fmt.Errorf("no user with email %v: %w", *email, err)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeExport(f, userID); err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+
+	fmt.Printf("wrote export to %v\n", *out)
+	return f.Close()
+}
+
+// runEmbeddingUsageCommand prints how many embedding tokens each user used per day.
+func runEmbeddingUsageCommand(args []string) error {
+	fs := flag.NewFlagSet("embedding-usage", flag.ExitOnError)
+	days := fs.Int("days", 7, "number of days to show, including today")
+	fs.Parse(args)
+
+	if *days <= 0 {
+		fs.Usage()
+		return fmt.Errorf("-days must be positive")
+	}
+
+	initDatabase()
+
+	usage, err := getEmbeddingUsage(usageDay(time.Now().AddDate(0, 0, 1-*days)))
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DAY\tUSER\tTOKENS\tREQUESTS")
+	var total int64
+	for _, u := range usage {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", u.Day.Format(time.DateOnly), u.Email, u.Tokens, u.Requests)
+		total += u.Tokens
+	}
+	fmt.Fprintf(tw, "total\t\t%v\t\n", total)
+	return tw.Flush()
+}
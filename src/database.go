@@ -2,62 +2,191 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"html"
 	"html/template"
 	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pgvector/pgvector-go"
 )
 
 type Post struct {
-	ID        int
-	UserID    int
-	URL       string
-	Title     string
-	Body      string
-	IsRead    bool
-	IsLiked   bool
-	TimeAdded int64
+	ID           int
+	UserID       int
+	URL          string
+	CanonicalURL string
+	Title        string
+	Body         string
+	State        string // one of the post states in state.go
+	IsLiked      bool
+	TimeAdded    int64
+	TimeArchived int64 // 0 if not archived or not known
+	TimeLiked    int64
+	TimeTrashed  int64 // 0 unless trashed
+
+	ReadProgress   float64 // percent of the post scrolled through
+	ProgressAnchor string  // block the reader was at, see postView.html
+
+	PostMetadata
+
+	Tags          []string
+	SuggestedTags []TagSuggestion // only set on the entry returned when saving
+
+	Summary       Summary
+	SummaryStatus string // "" if not summarized, otherwise pending, processing, done or failed
 
 	BodyHTML template.HTML
 }
 
+// PostMetadata is what we know about an article besides its content, all of it
+// optional.
+type PostMetadata struct {
+	Byline        string
+	SiteName      string
+	Excerpt       string
+	LeadImage     string
+	TimePublished int64 // 0 if not known
+	WordCount     int   // 0 if not counted yet
+}
+
+func (m PostMetadata) ReadingMinutes() int {
+	return readingMinutes(m.WordCount)
+}
+
+// postMetadataColumns selects the metadata columns in the order scanned by
+// PostMetadata.scanDest.
+const postMetadataColumns = `coalesce(byline, ''), coalesce(site_name, ''), coalesce(excerpt, ''), coalesce(lead_image, ''), coalesce(time_published, 0), coalesce(word_count, 0)`
+
+func (p Post) IsArchived() bool {
+	return p.State == stateArchived
+}
+
+func (p Post) IsReading() bool {
+	return p.State == stateReading
+}
+
+func (p Post) IsTrashed() bool {
+	return p.State == stateTrashed
+}
+
+// ProgressPercent is the reading progress rounded for display, 0 for posts which
+// haven't been started or are already archived.
+func (p Post) ProgressPercent() int {
+	if p.IsArchived() {
+		return 0
+	}
+	return int(math.Round(p.ReadProgress))
+}
+
+// DaysUntilPurge is how many days a trashed post has left before it's deleted.
+func (p Post) DaysUntilPurge() int {
+	left := time.Until(time.Unix(p.TimeTrashed, 0).Add(trashRetention))
+	return max(0, int(math.Ceil(left.Hours()/24)))
+}
+
+// ShowLeadImage is whether the lead image should be shown above the body, which
+// readability usually keeps in the article itself.
+func (p Post) ShowLeadImage() bool {
+	if p.LeadImage == "" {
+		return false
+	}
+	body := string(p.BodyHTML)
+	return !strings.Contains(body, p.LeadImage) && !strings.Contains(body, html.EscapeString(p.LeadImage))
+}
+
+func (m *PostMetadata) scanDest() []any {
+	return []any{&m.Byline, &m.SiteName, &m.Excerpt, &m.LeadImage, &m.TimePublished, &m.WordCount}
+}
+
+// errDuplicatePost is returned when saving a post the user already has, by canonical url.
+var errDuplicatePost = errors.New("post already saved")
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
 func logError(logger *slog.Logger, msg string, err error, attr ...any) {
 	args := append([]any{"error", err}, attr...)
 	logger.Error(msg, args...)
 }
 
-// if read is true gets only read posts, otherwise only unread posts
-func getUserPostsInfo(userID int, getReadPosts bool) []Post {
+// getUserPostsInfo returns a page of the user's posts in the given states, starting
+// after cursor (nil for the first page). The returned cursor is "" if there are no
+// more pages.
+func getUserPostsInfo(userID int, states []string, opts PostListOptions, cursor []string) ([]Post, string) {
 	ctx := context.Background()
 
-	logger := slog.Default().With("func", "getUserPosts", "userID", userID, "getReadPosts", getReadPosts)
+	logger := slog.Default().With("func", "getUserPosts", "userID", userID, "states", states,
+		"sort", opts.Sort.Key, "length", opts.Length.Key)
 	defer logger.Info("query")
 
-	// Query the database
+	keys := opts.sortKeys()
+	args := []any{userID, states}
+
+	where := "user_id = $1 AND state = ANY($2)"
+	if cond := opts.Length.sql(); cond != "" {
+		where += " AND " + cond
+	}
+	if cursor != nil {
+		where += " AND " + keysetSQL(keys, len(args)+1)
+		for _, value := range cursor {
+			args = append(args, value)
+		}
+	}
+
+	// the sort keys of each row, to make the cursor for the next page from
+	keyColumns := make([]string, len(keys))
+	for i, key := range keys {
+		keyColumns[i] = "(" + key.expr + ")::text"
+	}
+
+	// Query the database, one extra row to tell if there's another page
 	rows, err := db.Query(ctx, `
-    SELECT id, url, title, is_read, is_liked
+    SELECT id, url, title, state, is_liked, read_progress, coalesce(progress_anchor, ''), coalesce(time_trashed, 0), `+postMetadataColumns+`, `+strings.Join(keyColumns, ", ")+`
     FROM posts 
-    WHERE user_id = $1 AND is_read = $2 
-    ORDER BY time_added DESC`,
-		userID, getReadPosts)
+    WHERE `+where+`
+    ORDER BY `+orderSQL(keys)+`
+    LIMIT `+fmt.Sprint(postPageSize+1),
+		args...)
 	if err != nil {
 		logError(logger, "query to get user posts failed", err)
-		return []Post{}
+		return []Post{}, ""
 	}
 	defer rows.Close()
 
 	postEntries := []Post{}
+	var lastKeys []string
+	nextCursor := ""
 	// Iterate over the row results
 	for rows.Next() {
+		if len(postEntries) == postPageSize {
+			nextCursor = encodeCursor(lastKeys)
+			break
+		}
+
 		var postEntry Post
-		err := rows.Scan(&postEntry.ID, &postEntry.URL, &postEntry.Title, &postEntry.IsRead, &postEntry.IsLiked)
+		rowKeys := make([]string, len(keys))
+		dest := append([]any{&postEntry.ID, &postEntry.URL, &postEntry.Title, &postEntry.State, &postEntry.IsLiked, &postEntry.ReadProgress, &postEntry.ProgressAnchor, &postEntry.TimeTrashed},
+			postEntry.scanDest()...)
+		for i := range rowKeys {
+			dest = append(dest, &rowKeys[i])
+		}
+		err := rows.Scan(dest...)
 		if err != nil {
 			logError(logger, "query row scan failed", err)
 			continue
 		}
 		postEntries = append(postEntries, postEntry)
+		lastKeys = rowKeys
 	}
 
 	// Check for any error encountered during iteration
@@ -65,23 +194,45 @@ func getUserPostsInfo(userID int, getReadPosts bool) []Post {
 		logError(logger, "query row iteration error", err)
 	}
 
-	return postEntries
+	return postEntries, nextCursor
 }
 
-func searchUserPosts(userID int, query string) []Post {
+// tsQueryAcrossLanguages parses $2 as a query with every text search configuration
+// posts are indexed with, matching posts which match it in any of them.
+var tsQueryAcrossLanguages = func() string {
+	configs := []string{"english", "simple"}
+	for _, config := range textSearchConfigs {
+		if !slices.Contains(configs, config) {
+			configs = append(configs, config)
+		}
+	}
+	slices.Sort(configs)
+
+	var queries []string
+	for _, config := range configs {
+		queries = append(queries, fmt.Sprintf("plainto_tsquery('%v', $2)", config))
+	}
+	return strings.Join(queries, " || ")
+}()
+
+// searchUserPosts full text searches the user's posts matching filter, a condition
+// from Search.filterSQL.
+func searchUserPosts(userID int, query string, filter string, limit int) []Post {
 	ctx := context.Background()
 
 	logger := slog.Default().With("func", "searchUserPosts", "userID", userID, "query", query)
 	defer logger.Info("query")
 
 	queryString := `
-    SELECT id, url, title, is_read, is_liked, ts_rank_cd(tsvector_content, plainto_tsquery('english', $2)) AS rank
-    FROM posts
-    WHERE user_id = $1 AND tsvector_content @@ plainto_tsquery('english', $2)
-    ORDER BY rank DESC;
+    WITH q AS (SELECT ` + tsQueryAcrossLanguages + ` AS query)
+    SELECT id, url, title, state, is_liked, read_progress, coalesce(progress_anchor, ''), ` + postMetadataColumns + `, ts_rank_cd(tsvector_content, q.query) AS rank
+    FROM posts, q
+    WHERE user_id = $1 AND ` + filter + ` AND tsvector_content @@ q.query
+    ORDER BY rank DESC
+    LIMIT $3;
 `
 	// Execute the database query.
-	rows, err := db.Query(ctx, queryString, userID, query)
+	rows, err := db.Query(ctx, queryString, userID, query, limit)
 	if err != nil {
 		logError(logger, "query to get user posts failed", err)
 		return []Post{}
@@ -95,7 +246,9 @@ func searchUserPosts(userID int, query string) []Post {
 	for rows.Next() {
 		var postEntry Post
 		var rank float32 // don't actually care about this
-		err := rows.Scan(&postEntry.ID, &postEntry.URL, &postEntry.Title, &postEntry.IsRead, &postEntry.IsLiked, &rank)
+		dest := append([]any{&postEntry.ID, &postEntry.URL, &postEntry.Title, &postEntry.State, &postEntry.IsLiked, &postEntry.ReadProgress, &postEntry.ProgressAnchor},
+			postEntry.scanDest()...)
+		err := rows.Scan(append(dest, &rank)...)
 		if err != nil {
 			logError(logger, "query row scan failed", err)
 			continue
@@ -112,21 +265,113 @@ func searchUserPosts(userID int, query string) []Post {
 	return postEntries
 }
 
-func searchUserPostsByEmbedding(userID int, queryEmbedding []float32) []Post {
+// quick find matches words of titles and sites this similar to the query, so typos
+// and unfinished words still match
+const quickFindSimilarity = 0.45
+
+// quickFindMatch is the condition for posts quick find matches, with the query as $2
+// and it as a LIKE pattern as $3
+const quickFindMatch = `($2 <% title OR $2 <% url_host OR title ILIKE $3 OR url_host ILIKE $3)`
+
+// setQuickFindThreshold sets the similarity <% uses in quickFindMatch for the rest of
+// the transaction.
+func setQuickFindThreshold(ctx context.Context, tx pgx.Tx) error {
+	// <% uses the threshold, and can use the trigram indexes where a function call can't
+	_, err := tx.Exec(ctx, `SELECT set_config('pg_trgm.word_similarity_threshold', $1, true)`,
+		strconv.FormatFloat(quickFindSimilarity, 'f', -1, 64))
+	return err
+}
+
+// quickFindPosts returns the user's posts matching filter whose title or site matches
+// the query, by trigram similarity to a word of either or as a substring of either,
+// best first.
+func quickFindPosts(userID int, query string, filter string, limit int) ([]Post, error) {
+	logger := slog.Default().With("func", "quickFindPosts", "userID", userID, "query", query)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setQuickFindThreshold(ctx, tx); err != nil {
+		logError(logger, "failed to set similarity threshold", err)
+		return nil, err
+	}
+
+	sql := `
+    SELECT id, url, title, state, is_liked, read_progress, coalesce(progress_anchor, ''), ` + postMetadataColumns + `
+    FROM posts
+    WHERE user_id = $1 AND ` + filter + ` AND ` + quickFindMatch + `
+    ORDER BY greatest(word_similarity($2, title), word_similarity($2, coalesce(url_host, '')))
+             + CASE WHEN title ILIKE $3 OR url_host ILIKE $3 THEN 1 ELSE 0 END DESC,
+             time_added DESC
+    LIMIT $4`
+
+	rows, err := tx.Query(ctx, sql, userID, query, "%"+escapeLike(query)+"%", limit)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+
+	posts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Post, error) {
+		var post Post
+		dest := append([]any{&post.ID, &post.URL, &post.Title, &post.State, &post.IsLiked, &post.ReadProgress, &post.ProgressAnchor},
+			post.scanDest()...)
+		err := row.Scan(dest...)
+		return post, err
+	})
+	if err != nil {
+		logError(logger, "failed to collect rows", err)
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+// escapeLike escapes the characters LIKE patterns treat specially.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// searchUserPostsByEmbedding returns the user's posts matching filter which are at
+// least minSearchSimilarity similar to the query, nearest first. The hnsw index finds
+// the nearest posts of all users, only some of which are left once filtered, so with
+// exact the posts are sorted without it and every match is found, like
+// countSearchPosts counts them.
+func searchUserPostsByEmbedding(userID int, queryEmbedding []float32, filter string, limit int, exact bool) []Post {
 	ctx := context.Background()
 
-	logger := slog.Default().With("func", "searchUserPostsByEmbedding", "userID", userID)
+	logger := slog.Default().With("func", "searchUserPostsByEmbedding", "userID", userID, "exact", exact)
 	defer logger.Info("query")
 
 	queryString := `
-    SELECT id, url, title, is_read, is_liked
+    SELECT id, url, title, state, is_liked, read_progress, coalesce(progress_anchor, ''), ` + postMetadataColumns + `
     FROM posts
-    WHERE user_id = $1
+    WHERE user_id = $1 AND ` + filter + ` AND (embedding <#> $2) <= -$3::float8
     ORDER BY (embedding <#> $2)
-    LIMIT 20;
+    LIMIT $4;
+    `
+	if exact {
+		// the index can't sort a materialized cte
+		queryString = `
+    WITH matches AS MATERIALIZED (
+        SELECT id, embedding <#> $2 AS distance
+        FROM posts
+        WHERE user_id = $1 AND ` + filter + ` AND (embedding <#> $2) <= -$3::float8
+    )
+    SELECT id, url, title, state, is_liked, read_progress, coalesce(progress_anchor, ''), ` + postMetadataColumns + `
+    FROM posts JOIN matches USING (id)
+    ORDER BY matches.distance
+    LIMIT $4;
     `
+	}
 
-	rows, err := db.Query(ctx, queryString, userID, pgvector.NewVector(queryEmbedding))
+	rows, err := db.Query(ctx, queryString, userID, pgvector.NewVector(queryEmbedding), minSearchSimilarity, limit)
 	if err != nil {
 		logError(logger, "query to search user posts failed", err)
 		return []Post{}
@@ -137,7 +382,9 @@ func searchUserPostsByEmbedding(userID int, queryEmbedding []float32) []Post {
 
 	for rows.Next() {
 		var postEntry Post
-		err := rows.Scan(&postEntry.ID, &postEntry.URL, &postEntry.Title, &postEntry.IsRead, &postEntry.IsLiked)
+		dest := append([]any{&postEntry.ID, &postEntry.URL, &postEntry.Title, &postEntry.State, &postEntry.IsLiked, &postEntry.ReadProgress, &postEntry.ProgressAnchor},
+			postEntry.scanDest()...)
+		err := rows.Scan(dest...)
 		if err != nil {
 			logError(logger, "query row scan failed", err)
 			continue
@@ -153,14 +400,99 @@ func searchUserPostsByEmbedding(userID int, queryEmbedding []float32) []Post {
 	return postEntries
 }
 
-func markPostLiked(postID int, isLiked bool) error {
-	logger := slog.Default().With("func", "markPostLiked", "postID", postID, "isLiked", isLiked)
+// countSearchPosts counts up to limit posts matching the search, as searchPosts would
+// find them. Searches by meaning are counted with queryEmbedding, the query's
+// embedding, against every post rather than through the index, which only finds
+// the nearest few.
+func countSearchPosts(userID int, search Search, queryEmbedding []float32, limit int) (int, error) {
+	logger := slog.Default().With("func", "countSearchPosts", "userID", userID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	match, args := "true", []any{userID}
+	switch {
+	case search.Query == "":
+	case search.Mode == searchModeFind:
+		if err := setQuickFindThreshold(ctx, tx); err != nil {
+			logError(logger, "failed to set similarity threshold", err)
+			return 0, err
+		}
+		match, args = quickFindMatch, append(args, search.Query, "%"+escapeLike(search.Query)+"%")
+	default:
+		match, args = `(embedding <#> $2) <= -$3::float8`, append(args, pgvector.NewVector(queryEmbedding), minSearchSimilarity)
+	}
+
+	var count int
+	err = tx.QueryRow(ctx, fmt.Sprintf(`
+    SELECT count(*) FROM (
+        SELECT 1 FROM posts
+        WHERE user_id = $1 AND %v AND %v
+        LIMIT $%v
+    ) matches`, search.filterSQL(), match, len(args)+1), append(args, limit)...).Scan(&count)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// getFilteredPosts returns the user's newest posts matching filter, for searches
+// which only filter.
+func getFilteredPosts(userID int, filter string, limit int) ([]Post, error) {
+	logger := slog.Default().With("func", "getFilteredPosts", "userID", userID)
+	defer logger.Info("query")
+
+	rows, err := db.Query(context.Background(), `
+    SELECT id, url, title, state, is_liked, read_progress, coalesce(progress_anchor, ''), `+postMetadataColumns+`
+    FROM posts
+    WHERE user_id = $1 AND `+filter+`
+    ORDER BY time_added DESC
+    LIMIT $2`, userID, limit)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+
+	posts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Post, error) {
+		var post Post
+		dest := append([]any{&post.ID, &post.URL, &post.Title, &post.State, &post.IsLiked, &post.ReadProgress, &post.ProgressAnchor},
+			post.scanDest()...)
+		err := row.Scan(dest...)
+		return post, err
+	})
+	if err != nil {
+		logError(logger, "failed to collect rows", err)
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+// timeSetSQL returns an expression for a timestamp column which records when a boolean
+// flag was last turned on: it's set to now when the flag goes from false to true,
+// kept if the flag stays true and cleared when it's turned off.
+func timeSetSQL(flagColumn, timeColumn, param string) string {
+	return fmt.Sprintf(`CASE WHEN NOT %[3]s::boolean THEN NULL WHEN %[1]s THEN %[2]s ELSE extract(epoch from now())::bigint END`,
+		flagColumn, timeColumn, param)
+}
+
+func markPostLiked(postID, userID int, isLiked bool) error {
+	logger := slog.Default().With("func", "markPostLiked", "postID", postID, "userID", userID, "isLiked", isLiked)
 	defer logger.Info("query")
 
 	ctx := context.Background() // Acquire a context; in real applications, pass this from higher up the call chain. TODO:
 
-	sql := `UPDATE posts SET is_liked = $2 WHERE id = $1`
-	commandTag, err := db.Exec(ctx, sql, postID, isLiked)
+	sql := `UPDATE posts SET is_liked = $3, time_liked = ` + timeSetSQL("is_liked", "time_liked", "$3") + ` WHERE id = $1 AND user_id = $2`
+	commandTag, err := db.Exec(ctx, sql, postID, userID, isLiked)
 	if err != nil {
 		logError(logger, "query to mark post liked failed", err)
 		return err
@@ -174,61 +506,127 @@ func markPostLiked(postID int, isLiked bool) error {
 
 	return nil
 }
-func markPostRead(postID int, isRead bool) error {
-	logger := slog.Default().With("func", "markPostRead", "postID", postID, "isRead", isRead)
+
+// saveReadingProgress stores how far the user got in a post and returns the state
+// the post is in. Progress isn't kept for trashed posts.
+func saveReadingProgress(postID, userID int, percent float64, anchor string) (string, error) {
+	logger := slog.Default().With("func", "saveReadingProgress", "postID", postID, "userID", userID, "percent", percent)
+	defer logger.Info("query")
+
+	sql := `
+    UPDATE posts SET read_progress = $3, progress_anchor = nullif($4, '')
+    WHERE id = $1 AND user_id = $2 AND state <> 'trashed'
+    RETURNING state`
+
+	var state string
+	err := db.QueryRow(context.Background(), sql, postID, userID, percent, anchor).Scan(&state)
+	if err == pgx.ErrNoRows {
+		return "", errStateTransition
+	} else if err != nil {
+		logError(logger, "query to save reading progress failed", err)
+		return "", err
+	}
+
+	return state, nil
+}
+
+// errStateTransition is returned when a post doesn't exist or can't move to the
+// requested state from the one it's in.
+var errStateTransition = errors.New("post can't move to that state")
+
+// setPostState moves a post to a new state if postStateTransitions allows it. Setting
+// the state a post is already in does nothing.
+func setPostState(postID, userID int, state string) error {
+	logger := slog.Default().With("func", "setPostState", "postID", postID, "userID", userID, "state", state)
 	defer logger.Info("query")
 
+	from, ok := postStateTransitions[state]
+	if !ok {
+		return errInvalidState
+	}
+
 	ctx := context.Background()
 
-	sql := `UPDATE posts SET is_read = $2 WHERE id = $1`
-	commandTag, err := db.Exec(ctx, sql, postID, isRead)
+	// in SET the state column still refers to the old state. time_archived is kept
+	// through the trash so that restored posts keep it.
+	sql := `
+    UPDATE posts SET
+        state = $3,
+        time_archived = CASE WHEN state = $3 THEN time_archived
+                             WHEN $3 = 'archived' THEN extract(epoch from now())::bigint
+                             WHEN $3 = 'trashed' THEN time_archived
+                             ELSE NULL END,
+        trashed_from = CASE WHEN state = $3 THEN trashed_from WHEN $3 = 'trashed' THEN state ELSE NULL END,
+        time_trashed = CASE WHEN state = $3 THEN time_trashed
+                            WHEN $3 = 'trashed' THEN extract(epoch from now())::bigint
+                            ELSE NULL END
+    WHERE id = $1 AND user_id = $2 AND (state = $3 OR state = ANY($4))`
+	commandTag, err := db.Exec(ctx, sql, postID, userID, state, from)
 	if err != nil {
-		logError(logger, "query to mark post liked failed", err)
+		logError(logger, "query to set post state failed", err)
+		return err
 	}
 
-	// Check if the query affected any rows.
 	if commandTag.RowsAffected() == 0 {
 		logger.Warn("no rows affected")
-		return fmt.Errorf("no rows affected")
+		return errStateTransition
 	}
 
 	return nil
 }
 
-// updatePostStatus updates both the read and liked status of a post given its ID.
-func updatePostStatus(postID, userID int, isRead, isLiked bool) error {
-	logger := slog.Default().With("func", "updatePostStatus", "postID", postID, "isLiked", isLiked, "isRead", isRead)
+// restorePost takes a post out of the trash, back to the state it was trashed from.
+func restorePost(postID, userID int) error {
+	logger := slog.Default().With("func", "restorePost", "postID", postID, "userID", userID)
 	defer logger.Info("query")
 
-	ctx := context.Background() // In a real application, pass context from higher up.
-
-	var sql string
-	var err error
-	var commandTag pgconn.CommandTag
-
-	// If isRead is false, ensure isLiked is also set to false regardless of the isLiked input.
-	if !isRead {
-		sql = `UPDATE posts SET is_read = false, is_liked = false WHERE id = $1 AND user_id = $2`
-		commandTag, err = db.Exec(ctx, sql, postID, userID)
-	} else {
-		sql = `UPDATE posts SET is_read = $2, is_liked = $3 WHERE id = $1 AND user_id = $4`
-		commandTag, err = db.Exec(ctx, sql, postID, isRead, isLiked, userID)
-	}
-
+	sql := `
+    UPDATE posts SET state = coalesce(trashed_from, 'inbox'), trashed_from = NULL, time_trashed = NULL
+    WHERE id = $1 AND user_id = $2 AND state = 'trashed'`
+	commandTag, err := db.Exec(context.Background(), sql, postID, userID)
 	if err != nil {
-		logError(logger, "query to update post status failed", err)
+		logError(logger, "query to restore post failed", err)
 		return err
 	}
 
-	// Check if the query affected any rows.
 	if commandTag.RowsAffected() == 0 {
 		logger.Warn("no rows affected")
-		return fmt.Errorf("no rows affected")
+		return errStateTransition
+	}
+
+	return nil
+}
+
+// emptyTrash permanently deletes all of the user's trashed posts.
+func emptyTrash(userID int) error {
+	logger := slog.Default().With("func", "emptyTrash", "userID", userID)
+	defer logger.Info("query")
+
+	_, err := db.Exec(context.Background(), `DELETE FROM posts WHERE user_id = $1 AND state = 'trashed'`, userID)
+	if err != nil {
+		logError(logger, "query to empty trash failed", err)
+		return err
 	}
 
 	return nil
 }
 
+// purgeTrashedPosts permanently deletes posts of all users which were trashed before
+// the given unix time.
+func purgeTrashedPosts(trashedBefore int64) (int64, error) {
+	logger := slog.Default().With("func", "purgeTrashedPosts", "trashedBefore", trashedBefore)
+	defer logger.Info("query")
+
+	commandTag, err := db.Exec(context.Background(),
+		`DELETE FROM posts WHERE state = 'trashed' AND time_trashed < $1`, trashedBefore)
+	if err != nil {
+		logError(logger, "query to purge trashed posts failed", err)
+		return 0, err
+	}
+
+	return commandTag.RowsAffected(), nil
+}
+
 func getHashedPasswordAndUserId(email string) (string, int, error) {
 	logger := slog.Default().With("func", "getHashedPasswordAndUserId", "email", email)
 	defer logger.Info("query")
@@ -256,17 +654,23 @@ func getPostContent(postID int, userID int) (Post, error) {
 
 	ctx := context.Background()
 
-	sql := `SELECT id, url, title, body, is_read, is_liked FROM posts WHERE id = $1 AND user_id = $2`
+	sql := `SELECT id, url, title, body, state, is_liked, read_progress, coalesce(progress_anchor, ''), coalesce(time_trashed, 0), ` + postMetadataColumns + `,
+    coalesce(summary_status, ''), coalesce(summary_tldr, ''), coalesce(summary_points, '{}')
+    FROM posts WHERE id = $1 AND user_id = $2`
 	row := db.QueryRow(ctx, sql, postID, userID)
 
 	var post Post
 	var bodyStr string
 
-	err := row.Scan(&post.ID, &post.URL, &post.Title, &bodyStr, &post.IsRead, &post.IsLiked)
+	dest := append([]any{&post.ID, &post.URL, &post.Title, &bodyStr, &post.State, &post.IsLiked, &post.ReadProgress, &post.ProgressAnchor, &post.TimeTrashed}, post.scanDest()...)
+	err := row.Scan(append(dest, &post.SummaryStatus, &post.Summary.TLDR, &post.Summary.KeyPoints)...)
 	if err != nil {
 		logError(logger, "row scan failed", err)
 		return Post{}, err
 	}
+	if sanitizeOnRender {
+		bodyStr = sanitizeHTML(bodyStr)
+	}
 	post.BodyHTML = template.HTML(bodyStr)
 
 	return post, nil
@@ -278,11 +682,45 @@ func savePost(post Post) (int, error) {
 
 	ctx := context.Background()
 
-	sql := `INSERT INTO posts (url, title, body, is_read, is_liked, time_added, user_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	// never trust that the body was sanitized by whoever produced it
+	post.Body = sanitizeHTML(post.Body)
+	post.WordCount = countWords(post.Body)
+	language := detectLanguage(post.Title, post.Body)
+
+	if post.CanonicalURL == "" {
+		post.CanonicalURL = canonicalizeURL(post.URL)
+	}
+	if post.State == "" {
+		post.State = stateInbox
+	}
+	// posts saved already read or liked, like imported ones, were so when they were
+	// added unless we know better
+	if post.State != stateArchived {
+		post.TimeArchived = 0
+	} else if post.TimeArchived == 0 {
+		post.TimeArchived = post.TimeAdded
+	}
+	if !post.IsLiked {
+		post.TimeLiked = 0
+	} else if post.TimeLiked == 0 {
+		post.TimeLiked = post.TimeAdded
+	}
+
+	sql := `
+    INSERT INTO posts (url, canonical_url, title, body, state, is_liked, time_added, user_id,
+                       byline, site_name, excerpt, lead_image, time_published, word_count, language,
+                       time_archived, time_liked)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, nullif($13, 0), $14, $15, nullif($16, 0), nullif($17, 0))
+    RETURNING id`
 
 	var id int // returned id
-	err := db.QueryRow(ctx, sql, post.URL, post.Title, post.Body, post.IsRead, post.IsLiked, post.TimeAdded, post.UserID).Scan(&id)
-	if err != nil {
+	err := db.QueryRow(ctx, sql, post.URL, post.CanonicalURL, post.Title, post.Body, post.State, post.IsLiked, post.TimeAdded, post.UserID,
+		post.Byline, post.SiteName, post.Excerpt, post.LeadImage, post.TimePublished, post.WordCount, language,
+		post.TimeArchived, post.TimeLiked).Scan(&id)
+	if isUniqueViolation(err) {
+		logger.Info("post already saved", "canonicalURL", post.CanonicalURL)
+		return 0, errDuplicatePost
+	} else if err != nil {
 		logError(logger, "query row failed", err)
 		return 0, err
 	}
@@ -290,13 +728,14 @@ func savePost(post Post) (int, error) {
 	return id, nil
 }
 
+// deletePost permanently deletes a post, which has to be in the trash already.
 func deletePost(userID int, postID int) error {
 	logger := slog.Default().With("func", "deletePost", "userID", userID, "postID", postID)
 	defer logger.Info("query")
 
 	ctx := context.Background()
 
-	sql := `DELETE FROM posts WHERE id = $1 AND user_id = $2`
+	sql := `DELETE FROM posts WHERE id = $1 AND user_id = $2 AND state = 'trashed'`
 
 	// Execute the deletion
 	result, err := db.Exec(ctx, sql, postID, userID)
@@ -350,15 +789,1847 @@ func createUser(email, hashedPassword string) (int, error) {
 	return id, nil
 }
 
-func setPostEmbedding(postID int, embedding []float32) error {
+func setPostEmbedding(postID int, space embeddingSpace, embedding []float32) error {
 	logger := slog.Default().With("func", "setPostEmbedding", "postID", postID)
 	defer logger.Info("query")
 
-	query := `UPDATE posts SET embedding = $1 WHERE id = $2`
-	_, err := db.Exec(context.Background(), query, pgvector.NewVector(embedding), postID)
+	// a new embedding changes which posts are related, so bump the library version
+	// which cached related posts are checked against
+	query := `
+    WITH updated AS (
+        UPDATE posts SET embedding = $1, embedding_model = $3, embedding_dimensions = $4
+        WHERE id = $2 RETURNING user_id
+    )
+    UPDATE users SET library_version = library_version + 1 WHERE id IN (SELECT user_id FROM updated)`
+	_, err := db.Exec(context.Background(), query, pgvector.NewVector(embedding), postID, space.Model, space.Dimensions)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+	return nil
+}
+
+func getUserIdByEmail(email string) (int, error) {
+	logger := slog.Default().With("func", "getUserIdByEmail", "email", email)
+	defer logger.Info("query")
+
+	var userID int
+	err := db.QueryRow(context.Background(), `SELECT id FROM users WHERE email = $1`, email).Scan(&userID)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// createImport stores an import and queues all its items for extraction, returning the import id.
+func createImport(userID int, format string, items []ImportItem) (int, error) {
+	logger := slog.Default().With("func", "createImport", "userID", userID, "format", format, "count", len(items))
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var importID int
+	err = tx.QueryRow(ctx, `INSERT INTO imports (user_id, format, created_at) VALUES ($1, $2, $3) RETURNING id`,
+		userID, format, time.Now().Unix()).Scan(&importID)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return 0, err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"import_items"},
+		[]string{"import_id", "url", "title", "time_added", "is_read", "is_liked", "time_archived", "time_liked"},
+		pgx.CopyFromSlice(len(items), func(i int) ([]any, error) {
+			item := items[i]
+			return []any{importID, item.URL, item.Title, item.TimeAdded, item.IsRead, item.IsLiked, item.TimeArchived, item.TimeLiked}, nil
+		}))
+	if err != nil {
+		logError(logger, "copy import items failed", err)
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logError(logger, "failed to commit transaction", err)
+		return 0, err
+	}
+
+	return importID, nil
+}
+
+// getImport returns the import with its progress counts and the items which failed.
+func getImport(importID, userID int) (Import, error) {
+	logger := slog.Default().With("func", "getImport", "importID", importID, "userID", userID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	sql := `
+    SELECT i.id, i.user_id, i.format, i.created_at,
+        count(it.id),
+        count(it.id) FILTER (WHERE it.status IN ('pending', 'processing')),
+        count(it.id) FILTER (WHERE it.status = 'done'),
+        count(it.id) FILTER (WHERE it.status = 'failed')
+    FROM imports i
+    LEFT JOIN import_items it ON it.import_id = i.id
+    WHERE i.id = $1 AND i.user_id = $2
+    GROUP BY i.id`
+
+	var imp Import
+	err := db.QueryRow(ctx, sql, importID, userID).Scan(&imp.ID, &imp.UserID, &imp.Format, &imp.CreatedAt,
+		&imp.Total, &imp.Pending, &imp.Done, &imp.Failed)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return Import{}, err
+	}
+
+	rows, err := db.Query(ctx, `SELECT id, url, title, error FROM import_items WHERE import_id = $1 AND status = 'failed' ORDER BY id`, importID)
+	if err != nil {
+		logError(logger, "query to get failed import items failed", err)
+		return Import{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item ImportItem
+		if err := rows.Scan(&item.ID, &item.URL, &item.Title, &item.Error); err != nil {
+			logError(logger, "query row scan failed", err)
+			continue
+		}
+		imp.FailedItems = append(imp.FailedItems, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+	}
+
+	return imp, nil
+}
+
+// claimPendingImportItem marks the oldest pending import item as processing and
+// returns it. ok is false if there's nothing to do.
+func claimPendingImportItem() (item ImportItem, ok bool, err error) {
+	ctx := context.Background()
+
+	sql := `
+    UPDATE import_items it SET status = 'processing'
+    FROM imports i
+    WHERE it.import_id = i.id AND it.id = (
+        SELECT id FROM import_items
+        WHERE status = 'pending' AND retry_at <= extract(epoch from now())
+        ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+    )
+    RETURNING it.id, it.import_id, i.user_id, it.url, it.title, it.time_added, it.is_read, it.is_liked,
+        it.time_archived, it.time_liked, it.attempts`
+
+	err = db.QueryRow(ctx, sql).Scan(&item.ID, &item.ImportID, &item.UserID, &item.URL, &item.Title,
+		&item.TimeAdded, &item.IsRead, &item.IsLiked, &item.TimeArchived, &item.TimeLiked, &item.Attempts)
+	if err == pgx.ErrNoRows {
+		return ImportItem{}, false, nil
+	} else if err != nil {
+		return ImportItem{}, false, err
+	}
+
+	return item, true, nil
+}
+
+// finishImportItem marks an import item as done, or failed if errMsg isn't empty.
+func finishImportItem(itemID int, postID int, errMsg string) error {
+	logger := slog.Default().With("func", "finishImportItem", "itemID", itemID, "postID", postID)
+	defer logger.Info("query")
+
+	status := "done"
+	var post *int
+	if errMsg != "" {
+		status = "failed"
+	} else {
+		post = &postID
+	}
+
+	sql := `UPDATE import_items SET status = $2, error = $3, post_id = $4 WHERE id = $1`
+	_, err := db.Exec(context.Background(), sql, itemID, status, errMsg, post)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+
+	return nil
+}
+
+// retryImportItem puts an import item back in the queue, to be claimed again after
+// delay.
+func retryImportItem(itemID int, delay time.Duration) error {
+	logger := slog.Default().With("func", "retryImportItem", "itemID", itemID)
+	defer logger.Info("query")
+
+	sql := `
+    UPDATE import_items SET status = 'pending', attempts = attempts + 1,
+        retry_at = extract(epoch from now())::bigint + $2
+    WHERE id = $1`
+	_, err := db.Exec(context.Background(), sql, itemID, int64(delay.Seconds()))
 	if err != nil {
 		logError(logger, "query exec failed", err)
 		return err
 	}
+
+	return nil
+}
+
+// resetProcessingImportItems requeues items which were being processed when the server stopped.
+func resetProcessingImportItems() error {
+	_, err := db.Exec(context.Background(), `UPDATE import_items SET status = 'pending' WHERE status = 'processing'`)
+	return err
+}
+
+// streamUserPosts calls fn for each of the user's posts, oldest first, without
+// loading them all into memory at once.
+func streamUserPosts(userID int, fn func(Post) error) error {
+	logger := slog.Default().With("func", "streamUserPosts", "userID", userID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	sql := `
+    SELECT id, url, title, body, state, is_liked, coalesce(time_added, 0), coalesce(time_archived, 0), coalesce(time_liked, 0),
+           ` + postMetadataColumns + `
+    FROM posts
+    WHERE user_id = $1
+    ORDER BY time_added, id`
+
+	rows, err := db.Query(ctx, sql, userID)
+	if err != nil {
+		logError(logger, "query to stream user posts failed", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var post Post
+		dest := append([]any{&post.ID, &post.URL, &post.Title, &post.Body, &post.State, &post.IsLiked,
+			&post.TimeAdded, &post.TimeArchived, &post.TimeLiked}, post.scanDest()...)
+		err := rows.Scan(dest...)
+		if err != nil {
+			logError(logger, "query row scan failed", err)
+			return err
+		}
+		post.UserID = userID
+
+		if err := fn(post); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return err
+	}
+
+	return nil
+}
+
+func checkUserIdExists(userID int) (bool, error) {
+	ctx := context.Background()
+
+	var exists bool
+	err := db.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists)
+	if err != nil {
+		logError(slog.Default().With("func", "checkUserIdExists", "userID", userID), "query row failed", err)
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func getUserEmail(userID int) (string, error) {
+	logger := slog.Default().With("func", "getUserEmail", "userID", userID)
+	defer logger.Info("query")
+
+	var email string
+	err := db.QueryRow(context.Background(), `SELECT email FROM users WHERE id = $1`, userID).Scan(&email)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return "", err
+	}
+
+	return email, nil
+}
+
+// deleteUser removes the user and everything belonging to them (posts along with
+// their embeddings, imports, cached search queries) in one transaction.
+func deleteUser(userID int) error {
+	logger := slog.Default().With("func", "deleteUser", "userID", userID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, sql := range []string{
+		`DELETE FROM imports WHERE user_id = $1`,
+		`DELETE FROM posts WHERE user_id = $1`,
+		`DELETE FROM topics WHERE user_id = $1`,
+		`DELETE FROM tags WHERE user_id = $1`,
+		`DELETE FROM embedding_usage WHERE user_id = $1`,
+		`DELETE FROM query_embeddings WHERE user_id = $1`,
+		`DELETE FROM saved_searches WHERE user_id = $1`,
+		`DELETE FROM users WHERE id = $1`,
+	} {
+		if _, err := tx.Exec(ctx, sql, userID); err != nil {
+			logError(logger, "query exec failed", err, "sql", sql)
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logError(logger, "failed to commit transaction", err)
+		return err
+	}
+
+	return nil
+}
+
+type PostRevision struct {
+	ID        int
+	PostID    int
+	Title     string
+	Body      string
+	CreatedAt int64 // when this version was replaced
+}
+
+// updatePostContent replaces the title, body and metadata of a post, keeping the
+// previous title and body in post_revisions.
+func updatePostContent(postID, userID int, title, body string, meta PostMetadata) error {
+	logger := slog.Default().With("func", "updatePostContent", "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	body = sanitizeHTML(body)
+	meta.WordCount = countWords(body)
+	language := detectLanguage(title, body)
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `
+    INSERT INTO post_revisions (post_id, title, body, created_at)
+    SELECT id, title, body, $3 FROM posts WHERE id = $1 AND user_id = $2`
+	commandTag, err := tx.Exec(ctx, sql, postID, userID, time.Now().Unix())
+	if err != nil {
+		logError(logger, "query to save post revision failed", err)
+		return err
+	}
+	if commandTag.RowsAffected() == 0 {
+		logger.Warn("no rows affected")
+		return fmt.Errorf("no rows affected")
+	}
+
+	sql = `
+    UPDATE posts SET title = $3, body = $4, byline = $5, site_name = $6, excerpt = $7, lead_image = $8, time_published = nullif($9, 0),
+                     word_count = $10, language = $11, progress_anchor = NULL
+    WHERE id = $1 AND user_id = $2`
+	_, err = tx.Exec(ctx, sql, postID, userID, title, body, meta.Byline, meta.SiteName, meta.Excerpt, meta.LeadImage, meta.TimePublished,
+		meta.WordCount, language)
+	if err != nil {
+		logError(logger, "query to update post content failed", err)
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logError(logger, "failed to commit transaction", err)
+		return err
+	}
+
+	return nil
+}
+
+// getPostRevisions returns the previous versions of a post without their bodies, newest first.
+func getPostRevisions(postID, userID int) ([]PostRevision, error) {
+	logger := slog.Default().With("func", "getPostRevisions", "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT r.id, r.post_id, r.title, r.created_at
+    FROM post_revisions r
+    JOIN posts p ON p.id = r.post_id
+    WHERE r.post_id = $1 AND p.user_id = $2
+    ORDER BY r.id DESC`
+
+	rows, err := db.Query(context.Background(), sql, postID, userID)
+	if err != nil {
+		logError(logger, "query to get post revisions failed", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []PostRevision
+	for rows.Next() {
+		var rev PostRevision
+		if err := rows.Scan(&rev.ID, &rev.PostID, &rev.Title, &rev.CreatedAt); err != nil {
+			logError(logger, "query row scan failed", err)
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+
+	if err = rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// getPostRevisionPair returns the given revision of a post and the version which
+// replaced it, which is either the next revision or the current post.
+func getPostRevisionPair(revisionID, postID, userID int) (PostRevision, PostRevision, error) {
+	logger := slog.Default().With("func", "getPostRevisionPair", "revisionID", revisionID, "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	var old PostRevision
+	sql := `
+    SELECT r.id, r.post_id, r.title, r.body, r.created_at
+    FROM post_revisions r
+    JOIN posts p ON p.id = r.post_id
+    WHERE r.id = $1 AND r.post_id = $2 AND p.user_id = $3`
+	err := db.QueryRow(ctx, sql, revisionID, postID, userID).Scan(&old.ID, &old.PostID, &old.Title, &old.Body, &old.CreatedAt)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return PostRevision{}, PostRevision{}, err
+	}
+
+	var next PostRevision
+	sql = `
+    SELECT id, post_id, title, body, created_at FROM post_revisions
+    WHERE post_id = $1 AND id > $2
+    ORDER BY id LIMIT 1`
+	err = db.QueryRow(ctx, sql, postID, revisionID).Scan(&next.ID, &next.PostID, &next.Title, &next.Body, &next.CreatedAt)
+	if err == pgx.ErrNoRows {
+		// the revision was replaced by the current version
+		err = db.QueryRow(ctx, `SELECT id, title, body FROM posts WHERE id = $1`, postID).Scan(&next.PostID, &next.Title, &next.Body)
+	}
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return PostRevision{}, PostRevision{}, err
+	}
+
+	return old, next, nil
+}
+
+// findSavedPost returns the user's post with the given (canonicalized) url, matching
+// either its canonical url or the url it was saved with. ok is false if there's none.
+func findSavedPost(userID int, postURL string) (post Post, ok bool, err error) {
+	logger := slog.Default().With("func", "findSavedPost", "userID", userID, "url", postURL)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT id, url, coalesce(canonical_url, ''), title, state, is_liked, read_progress, coalesce(progress_anchor, ''), coalesce(time_added, 0), ` + postMetadataColumns + `
+    FROM posts
+    WHERE user_id = $1 AND (canonical_url = $2 OR url = $2)
+    ORDER BY id
+    LIMIT 1`
+
+	dest := append([]any{&post.ID, &post.URL, &post.CanonicalURL, &post.Title, &post.State, &post.IsLiked, &post.ReadProgress, &post.ProgressAnchor, &post.TimeAdded},
+		post.scanDest()...)
+	err = db.QueryRow(context.Background(), sql, userID, postURL).Scan(dest...)
+	if err == pgx.ErrNoRows {
+		return Post{}, false, nil
+	} else if err != nil {
+		logError(logger, "query row failed", err)
+		return Post{}, false, err
+	}
+
+	post.UserID = userID
+	return post, true, nil
+}
+
+// backfillCanonicalURLs sets canonical_url for posts saved before it existed. Posts
+// which turn out to be duplicates of another post are left without one and logged.
+func backfillCanonicalURLs() (updated int, duplicates int, err error) {
+	ctx := context.Background()
+
+	rows, err := db.Query(ctx, `SELECT id, url FROM posts WHERE canonical_url IS NULL ORDER BY id`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("query failed: %w", err)
+	}
+
+	type postURL struct {
+		id  int
+		url string
+	}
+	var posts []postURL
+	for rows.Next() {
+		var p postURL
+		if err := rows.Scan(&p.id, &p.url); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("row scan failed: %w", err)
+		}
+		posts = append(posts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	for _, p := range posts {
+		_, err := db.Exec(ctx, `UPDATE posts SET canonical_url = $2 WHERE id = $1`, p.id, canonicalizeURL(p.url))
+		if isUniqueViolation(err) {
+			slog.Warn("duplicate post, leaving without canonical url", "postID", p.id, "url", p.url)
+			duplicates++
+			continue
+		} else if err != nil {
+			return updated, duplicates, fmt.Errorf("update failed: %w", err)
+		}
+		updated++
+	}
+
+	return updated, duplicates, nil
+}
+
+// backfillWordCounts sets word_count for posts saved before it existed, a batch at a
+// time so that not every body has to be in memory at once.
+func backfillWordCounts() (updated int, err error) {
+	ctx := context.Background()
+
+	type postBody struct {
+		id   int
+		body string
+	}
+
+	for {
+		rows, err := db.Query(ctx, `SELECT id, body FROM posts WHERE word_count IS NULL ORDER BY id LIMIT 100`)
+		if err != nil {
+			return updated, fmt.Errorf("query failed: %w", err)
+		}
+
+		var posts []postBody
+		for rows.Next() {
+			var p postBody
+			if err := rows.Scan(&p.id, &p.body); err != nil {
+				rows.Close()
+				return updated, fmt.Errorf("row scan failed: %w", err)
+			}
+			posts = append(posts, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return updated, fmt.Errorf("row iteration error: %w", err)
+		}
+
+		if len(posts) == 0 {
+			return updated, nil
+		}
+
+		for _, p := range posts {
+			_, err := db.Exec(ctx, `UPDATE posts SET word_count = $2 WHERE id = $1`, p.id, countWords(p.body))
+			if err != nil {
+				return updated, fmt.Errorf("update failed: %w", err)
+			}
+			updated++
+		}
+	}
+}
+
+// backfillLanguages detects the language of posts saved before it was, a batch at a
+// time like backfillWordCounts. Setting it reindexes the post for full text search.
+func backfillLanguages() (updated int, err error) {
+	ctx := context.Background()
+
+	type postText struct {
+		id    int
+		title string
+		body  string
+	}
+
+	for {
+		rows, err := db.Query(ctx, `SELECT id, title, body FROM posts WHERE language IS NULL ORDER BY id LIMIT 100`)
+		if err != nil {
+			return updated, fmt.Errorf("query failed: %w", err)
+		}
+
+		var posts []postText
+		for rows.Next() {
+			var p postText
+			if err := rows.Scan(&p.id, &p.title, &p.body); err != nil {
+				rows.Close()
+				return updated, fmt.Errorf("row scan failed: %w", err)
+			}
+			posts = append(posts, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return updated, fmt.Errorf("row iteration error: %w", err)
+		}
+
+		if len(posts) == 0 {
+			return updated, nil
+		}
+
+		for _, p := range posts {
+			_, err := db.Exec(ctx, `UPDATE posts SET language = $2 WHERE id = $1`, p.id, detectLanguage(p.title, p.body))
+			if err != nil {
+				return updated, fmt.Errorf("update failed: %w", err)
+			}
+			updated++
+		}
+	}
+}
+
+// ScoredPost is a post with how similar it is to something, between -1 and 1.
+type ScoredPost struct {
+	Post
+	Similarity float64
+}
+
+// findSimilarPosts returns up to limit of the user's posts nearest to the embedding
+// of postID, most similar first, leaving out the post itself and trashed posts.
+// Returns nothing if the post has no embedding yet.
+func findSimilarPosts(postID, userID int, limit int) ([]ScoredPost, error) {
+	logger := slog.Default().With("func", "findSimilarPosts", "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	var embedding *pgvector.Vector
+	err := db.QueryRow(ctx, `SELECT embedding FROM posts WHERE id = $1 AND user_id = $2`, postID, userID).Scan(&embedding)
+	if err != nil {
+		logError(logger, "query for post embedding failed", err)
+		return nil, err
+	}
+	if embedding == nil {
+		return nil, nil
+	}
+
+	// embeddings are normalized, so the inner product is the cosine similarity
+	sql := `
+    SELECT id, url, title, state, ` + postMetadataColumns + `, -(embedding <#> $3) AS similarity
+    FROM posts
+    WHERE user_id = $2 AND id <> $1 AND state <> 'trashed' AND embedding IS NOT NULL
+    ORDER BY embedding <#> $3
+    LIMIT $4`
+
+	rows, err := db.Query(ctx, sql, postID, userID, *embedding, limit)
+	if err != nil {
+		logError(logger, "query for similar posts failed", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []ScoredPost
+	for rows.Next() {
+		var post ScoredPost
+		dest := append([]any{&post.ID, &post.URL, &post.Title, &post.State}, post.scanDest()...)
+		if err := rows.Scan(append(dest, &post.Similarity)...); err != nil {
+			logError(logger, "query row scan failed", err)
+			return nil, err
+		}
+		post.UserID = userID
+		posts = append(posts, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+// getCachedRelatedPostIDs returns the related posts cached for a post and the user's
+// current library version. ok is false if nothing is cached or the library changed
+// since.
+func getCachedRelatedPostIDs(postID, userID int) (ids []int, version int, ok bool, err error) {
+	logger := slog.Default().With("func", "getCachedRelatedPostIDs", "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT p.related_post_ids, coalesce(p.related_version = u.library_version, false), u.library_version
+    FROM posts p JOIN users u ON u.id = p.user_id
+    WHERE p.id = $1 AND p.user_id = $2`
+
+	err = db.QueryRow(context.Background(), sql, postID, userID).Scan(&ids, &ok, &version)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return nil, 0, false, err
+	}
+
+	return ids, version, ok && ids != nil, nil
+}
+
+func cacheRelatedPostIDs(postID int, ids []int, version int) error {
+	logger := slog.Default().With("func", "cacheRelatedPostIDs", "postID", postID)
+	defer logger.Info("query")
+
+	_, err := db.Exec(context.Background(), `UPDATE posts SET related_post_ids = $2, related_version = $3 WHERE id = $1`,
+		postID, ids, version)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+
+	return nil
+}
+
+// getPostsByIDs returns the user's posts with the given ids in the same order,
+// skipping ones which are gone or trashed.
+func getPostsByIDs(userID int, ids []int) ([]Post, error) {
+	logger := slog.Default().With("func", "getPostsByIDs", "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT id, url, title, state, ` + postMetadataColumns + `
+    FROM posts
+    WHERE user_id = $1 AND id = ANY($2) AND state <> 'trashed'
+    ORDER BY array_position($2, id)`
+
+	rows, err := db.Query(context.Background(), sql, userID, ids)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(append([]any{&post.ID, &post.URL, &post.Title, &post.State}, post.scanDest()...)...); err != nil {
+			logError(logger, "query row scan failed", err)
+			return nil, err
+		}
+		post.UserID = userID
+		posts = append(posts, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+// getUsersWithStaleTopics returns the users whose library changed since their topics
+// were last computed.
+func getUsersWithStaleTopics() ([]int, error) {
+	logger := slog.Default().With("func", "getUsersWithStaleTopics")
+	defer logger.Info("query")
+
+	rows, err := db.Query(context.Background(), `SELECT id FROM users WHERE topics_version IS DISTINCT FROM library_version`)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+
+	userIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		logError(logger, "query row scan failed", err)
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+type topicsState struct {
+	libraryVersion int
+	// number of posts at the last full clustering
+	clusteredPostCount int
+}
+
+func getTopicsState(userID int) (topicsState, error) {
+	logger := slog.Default().With("func", "getTopicsState", "userID", userID)
+	defer logger.Info("query")
+
+	var state topicsState
+	err := db.QueryRow(context.Background(), `SELECT library_version, topics_post_count FROM users WHERE id = $1`, userID).
+		Scan(&state.libraryVersion, &state.clusteredPostCount)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return topicsState{}, err
+	}
+
+	return state, nil
+}
+
+// getTopicPoints returns the user's posts with embeddings to cluster, and the ids of
+// their current topics. Each point's topic is an index into the ids.
+func getTopicPoints(userID int) ([]topicPoint, []int, error) {
+	logger := slog.Default().With("func", "getTopicPoints", "userID", userID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	rows, err := db.Query(ctx, `SELECT id FROM topics WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		logError(logger, "query for topics failed", err)
+		return nil, nil, err
+	}
+	topicIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		logError(logger, "query row scan failed", err)
+		return nil, nil, err
+	}
+
+	topicIndex := map[int]int{}
+	for i, id := range topicIDs {
+		topicIndex[id] = i
+	}
+
+	rows, err = db.Query(ctx, `
+    SELECT id, title, embedding, topic_id
+    FROM posts
+    WHERE user_id = $1 AND state <> 'trashed' AND embedding IS NOT NULL`, userID)
+	if err != nil {
+		logError(logger, "query for posts failed", err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var points []topicPoint
+	for rows.Next() {
+		var point topicPoint
+		var embedding pgvector.Vector
+		var topicID *int
+		if err := rows.Scan(&point.postID, &point.title, &embedding, &topicID); err != nil {
+			logError(logger, "query row scan failed", err)
+			return nil, nil, err
+		}
+		point.embedding = embedding.Slice()
+		point.topic = -1
+		if topicID != nil {
+			if i, ok := topicIndex[*topicID]; ok {
+				point.topic = i
+			}
+		}
+		points = append(points, point)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return nil, nil, err
+	}
+
+	return points, topicIDs, nil
+}
+
+// saveTopics replaces the user's topics with the given ones and sets the topic of
+// each post. Topics with an id are updated, the others created, and the user's
+// remaining topics and ones left without posts deleted.
+func saveTopics(userID int, topics []Topic, points []topicPoint, libraryVersion, clusteredPostCount int) error {
+	logger := slog.Default().With("func", "saveTopics", "userID", userID, "topics", len(topics))
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	keep := []int{}
+	for _, topic := range topics {
+		if topic.ID != 0 && topic.Size > 0 {
+			keep = append(keep, topic.ID)
+		}
+	}
+	// posts in deleted topics have their topic_id set to null
+	if _, err := tx.Exec(ctx, `DELETE FROM topics WHERE user_id = $1 AND NOT (id = ANY($2))`, userID, keep); err != nil {
+		logError(logger, "query to delete topics failed", err)
+		return err
+	}
+
+	now := time.Now().Unix()
+	for i, topic := range topics {
+		if topic.Size == 0 {
+			continue
+		}
+		if topic.ID == 0 {
+			err = tx.QueryRow(ctx, `INSERT INTO topics (user_id, label, size, time_updated) VALUES ($1, $2, $3, $4) RETURNING id`,
+				userID, topic.Label, topic.Size, now).Scan(&topics[i].ID)
+		} else {
+			_, err = tx.Exec(ctx, `UPDATE topics SET label = $2, size = $3, time_updated = $4 WHERE id = $1`,
+				topic.ID, topic.Label, topic.Size, now)
+		}
+		if err != nil {
+			logError(logger, "query to save topic failed", err)
+			return err
+		}
+	}
+
+	postIDs := make([]int, len(points))
+	topicIDs := make([]int, len(points))
+	for i, point := range points {
+		postIDs[i] = point.postID
+		topicIDs[i] = topics[point.topic].ID
+	}
+	_, err = tx.Exec(ctx, `
+    UPDATE posts SET topic_id = t.topic_id
+    FROM unnest($2::int[], $3::int[]) AS t(post_id, topic_id)
+    WHERE posts.id = t.post_id AND posts.user_id = $1 AND posts.topic_id IS DISTINCT FROM t.topic_id`,
+		userID, postIDs, topicIDs)
+	if err != nil {
+		logError(logger, "query to set post topics failed", err)
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET topics_version = $2, topics_post_count = $3 WHERE id = $1`,
+		userID, libraryVersion, clusteredPostCount)
+	if err != nil {
+		logError(logger, "query to update topics version failed", err)
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logError(logger, "failed to commit transaction", err)
+		return err
+	}
+
+	return nil
+}
+
+// getTopics returns the user's topics, biggest first, counting only posts which
+// aren't trashed.
+func getTopics(userID int) ([]Topic, error) {
+	logger := slog.Default().With("func", "getTopics", "userID", userID)
+	defer logger.Info("query")
+
+	rows, err := db.Query(context.Background(), `
+    SELECT t.id, t.label, count(p.id)
+    FROM topics t JOIN posts p ON p.topic_id = t.id AND p.state <> 'trashed'
+    WHERE t.user_id = $1
+    GROUP BY t.id
+    ORDER BY count(p.id) DESC, t.label`, userID)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	topics := []Topic{}
+	for rows.Next() {
+		var topic Topic
+		if err := rows.Scan(&topic.ID, &topic.Label, &topic.Size); err != nil {
+			logError(logger, "query row scan failed", err)
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return nil, err
+	}
+
+	return topics, nil
+}
+
+// getTopicPosts returns a topic and the posts in it which aren't trashed, newest first.
+func getTopicPosts(userID, topicID int) (Topic, []Post, error) {
+	logger := slog.Default().With("func", "getTopicPosts", "userID", userID, "topicID", topicID)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	topic := Topic{ID: topicID}
+	err := db.QueryRow(ctx, `SELECT label FROM topics WHERE id = $1 AND user_id = $2`, topicID, userID).Scan(&topic.Label)
+	if err != nil {
+		logError(logger, "query for topic failed", err)
+		return Topic{}, nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+    SELECT id, url, title, state, is_liked, read_progress, coalesce(progress_anchor, ''), `+postMetadataColumns+`
+    FROM posts
+    WHERE user_id = $1 AND topic_id = $2 AND state <> 'trashed'
+    ORDER BY time_added DESC, id DESC`, userID, topicID)
+	if err != nil {
+		logError(logger, "query for posts failed", err)
+		return Topic{}, nil, err
+	}
+	defer rows.Close()
+
+	posts := []Post{}
+	for rows.Next() {
+		var post Post
+		dest := append([]any{&post.ID, &post.URL, &post.Title, &post.State, &post.IsLiked, &post.ReadProgress, &post.ProgressAnchor},
+			post.scanDest()...)
+		if err := rows.Scan(dest...); err != nil {
+			logError(logger, "query row scan failed", err)
+			return Topic{}, nil, err
+		}
+		posts = append(posts, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return Topic{}, nil, err
+	}
+
+	topic.Size = len(posts)
+	return topic, posts, nil
+}
+
+func userHasTags(userID int) (bool, error) {
+	logger := slog.Default().With("func", "userHasTags", "userID", userID)
+	defer logger.Info("query")
+
+	var exists bool
+	err := db.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM tags WHERE user_id = $1)`, userID).Scan(&exists)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// getTagCentroidSimilarities returns the cosine similarity between the embedding and
+// the mean embedding of the posts with each of the user's tags, leaving out postID.
+func getTagCentroidSimilarities(postID, userID int, embedding []float32) (map[string]float64, error) {
+	logger := slog.Default().With("func", "getTagCentroidSimilarities", "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT t.name, 1 - (avg(p.embedding) <=> $3)
+    FROM tags t
+    JOIN post_tags pt ON pt.tag_id = t.id
+    JOIN posts p ON p.id = pt.post_id
+    WHERE t.user_id = $1 AND p.id <> $2 AND p.state <> 'trashed' AND p.embedding IS NOT NULL
+    GROUP BY t.id`
+
+	rows, err := db.Query(context.Background(), sql, userID, postID, pgvector.NewVector(embedding))
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	similarities := map[string]float64{}
+	for rows.Next() {
+		var name string
+		var similarity float64
+		if err := rows.Scan(&name, &similarity); err != nil {
+			logError(logger, "query row scan failed", err)
+			return nil, err
+		}
+		similarities[name] = similarity
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return nil, err
+	}
+
+	return similarities, nil
+}
+
+// getNearestTaggedPosts returns the tags of the limit tagged posts nearest to the
+// embedding, one row per post and tag.
+func getNearestTaggedPosts(postID, userID int, embedding []float32, limit int) ([]tagNeighbour, error) {
+	logger := slog.Default().With("func", "getNearestTaggedPosts", "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    WITH neighbours AS (
+        SELECT id, -(embedding <#> $3) AS similarity
+        FROM posts
+        WHERE user_id = $1 AND id <> $2 AND state <> 'trashed' AND embedding IS NOT NULL
+            AND EXISTS (SELECT 1 FROM post_tags WHERE post_id = posts.id)
+        ORDER BY embedding <#> $3
+        LIMIT $4
+    )
+    SELECT n.id, n.similarity, t.name
+    FROM neighbours n
+    JOIN post_tags pt ON pt.post_id = n.id
+    JOIN tags t ON t.id = pt.tag_id`
+
+	rows, err := db.Query(context.Background(), sql, userID, postID, pgvector.NewVector(embedding), limit)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var neighbours []tagNeighbour
+	for rows.Next() {
+		var n tagNeighbour
+		if err := rows.Scan(&n.postID, &n.similarity, &n.tag); err != nil {
+			logError(logger, "query row scan failed", err)
+			return nil, err
+		}
+		neighbours = append(neighbours, n)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return nil, err
+	}
+
+	return neighbours, nil
+}
+
+func getPostTags(postID, userID int) ([]string, error) {
+	logger := slog.Default().With("func", "getPostTags", "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT t.name
+    FROM post_tags pt JOIN tags t ON t.id = pt.tag_id
+    WHERE pt.post_id = $1 AND t.user_id = $2
+    ORDER BY t.name`
+
+	rows, err := db.Query(context.Background(), sql, postID, userID)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+
+	tags, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		logError(logger, "query row scan failed", err)
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// addPostTag tags one of the user's posts, creating the tag if it's new. added is
+// false if the post already had the tag.
+func addPostTag(postID, userID int, name string) (added bool, err error) {
+	logger := slog.Default().With("func", "addPostTag", "postID", postID, "userID", userID, "tag", name)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM posts WHERE id = $1 AND user_id = $2)`, postID, userID).Scan(&exists)
+	if err != nil {
+		logError(logger, "query for post failed", err)
+		return false, err
+	}
+	if !exists {
+		return false, pgx.ErrNoRows
+	}
+
+	var tagID int
+	err = tx.QueryRow(ctx, `
+    INSERT INTO tags (user_id, name) VALUES ($1, $2)
+    ON CONFLICT (user_id, name) DO UPDATE SET name = EXCLUDED.name
+    RETURNING id`, userID, name).Scan(&tagID)
+	if err != nil {
+		logError(logger, "query to create tag failed", err)
+		return false, err
+	}
+
+	tag, err := tx.Exec(ctx, `INSERT INTO post_tags (post_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, postID, tagID)
+	if err != nil {
+		logError(logger, "query to tag post failed", err)
+		return false, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logError(logger, "failed to commit transaction", err)
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// removePostTag untags a post, deleting the tag once no posts have it.
+func removePostTag(postID, userID int, name string) error {
+	logger := slog.Default().With("func", "removePostTag", "postID", postID, "userID", userID, "tag", name)
+	defer logger.Info("query")
+
+	sql := `
+    WITH removed AS (
+        DELETE FROM post_tags pt USING tags t
+        WHERE pt.tag_id = t.id AND pt.post_id = $1 AND t.user_id = $2 AND t.name = $3
+        RETURNING t.id
+    )
+    DELETE FROM tags
+    WHERE id IN (SELECT id FROM removed)
+        AND NOT EXISTS (SELECT 1 FROM post_tags WHERE tag_id = tags.id AND post_id <> $1)`
+
+	_, err := db.Exec(context.Background(), sql, postID, userID, name)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+
+	return nil
+}
+
+func getSummariesEnabled(userID int) (bool, error) {
+	logger := slog.Default().With("func", "getSummariesEnabled", "userID", userID)
+	defer logger.Info("query")
+
+	var enabled bool
+	err := db.QueryRow(context.Background(), `SELECT summaries_enabled FROM users WHERE id = $1`, userID).Scan(&enabled)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return false, err
+	}
+
+	return enabled, nil
+}
+
+func setSummariesEnabled(userID int, enabled bool) error {
+	logger := slog.Default().With("func", "setSummariesEnabled", "userID", userID, "enabled", enabled)
+	defer logger.Info("query")
+
+	_, err := db.Exec(context.Background(), `UPDATE users SET summaries_enabled = $2 WHERE id = $1`, userID, enabled)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+
+	return nil
+}
+
+// queuePostSummary marks a post to be summarized if the user has summaries turned
+// on, returning whether it was queued.
+func queuePostSummary(postID, userID int) (bool, error) {
+	logger := slog.Default().With("func", "queuePostSummary", "postID", postID, "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    UPDATE posts SET summary_status = 'pending'
+    WHERE id = $1 AND user_id = $2 AND (SELECT summaries_enabled FROM users WHERE id = $2)`
+
+	tag, err := db.Exec(context.Background(), sql, postID, userID)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// claimPendingSummary marks the oldest post waiting to be summarized as processing
+// and returns it. Posts of users who turned summaries off since stay queued until
+// they turn them on again.
+func claimPendingSummary() (post Post, ok bool, err error) {
+	ctx := context.Background()
+
+	sql := `
+    UPDATE posts SET summary_status = 'processing'
+    WHERE id = (
+        SELECT p.id FROM posts p JOIN users u ON u.id = p.user_id
+        WHERE p.summary_status = 'pending' AND u.summaries_enabled
+        ORDER BY p.id LIMIT 1 FOR UPDATE OF p SKIP LOCKED
+    )
+    RETURNING id, user_id, title, body`
+
+	err = db.QueryRow(ctx, sql).Scan(&post.ID, &post.UserID, &post.Title, &post.Body)
+	if err == pgx.ErrNoRows {
+		return Post{}, false, nil
+	} else if err != nil {
+		return Post{}, false, err
+	}
+
+	return post, true, nil
+}
+
+// finishPostSummary stores a post's summary, or marks it as failed.
+func finishPostSummary(postID int, summary Summary, ok bool) error {
+	logger := slog.Default().With("func", "finishPostSummary", "postID", postID, "ok", ok)
+	defer logger.Info("query")
+
+	var sql string
+	var args []any
+	if ok {
+		sql = `
+        UPDATE posts SET summary_status = 'done', summary_tldr = $2, summary_points = $3, time_summarized = $4
+        WHERE id = $1 AND summary_status = 'processing'`
+		args = []any{postID, summary.TLDR, summary.KeyPoints, time.Now().Unix()}
+	} else {
+		sql = `UPDATE posts SET summary_status = 'failed' WHERE id = $1 AND summary_status = 'processing'`
+		args = []any{postID}
+	}
+
+	_, err := db.Exec(context.Background(), sql, args...)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+
+	return nil
+}
+
+// resetProcessingSummaries requeues posts which were being summarized when the server stopped.
+func resetProcessingSummaries() error {
+	_, err := db.Exec(context.Background(), `UPDATE posts SET summary_status = 'pending' WHERE summary_status = 'processing'`)
+	return err
+}
+
+// getAskCandidatePosts returns the user's posts nearest to the embedding, with their
+// bodies, for answering a question from.
+func getAskCandidatePosts(userID int, embedding []float32, limit int) ([]ScoredPost, error) {
+	logger := slog.Default().With("func", "getAskCandidatePosts", "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT id, title, body, -(embedding <#> $2)
+    FROM posts
+    WHERE user_id = $1 AND state <> 'trashed' AND embedding IS NOT NULL
+    ORDER BY embedding <#> $2
+    LIMIT $3`
+
+	rows, err := db.Query(context.Background(), sql, userID, pgvector.NewVector(embedding), limit)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []ScoredPost
+	for rows.Next() {
+		var post ScoredPost
+		if err := rows.Scan(&post.ID, &post.Title, &post.Body, &post.Similarity); err != nil {
+			logError(logger, "query row scan failed", err)
+			return nil, err
+		}
+		post.UserID = userID
+		posts = append(posts, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(logger, "query row iteration error", err)
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+// getCachedQueryEmbedding looks up a persisted query embedding, marking it as used.
+func getCachedQueryEmbedding(userID int, model, query string) ([]float32, bool, error) {
+	logger := slog.Default().With("func", "getCachedQueryEmbedding", "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    UPDATE query_embeddings SET time_used = $4
+    WHERE user_id = $1 AND model = $2 AND query = $3
+    RETURNING embedding`
+
+	var embedding pgvector.Vector
+	err := db.QueryRow(context.Background(), sql, userID, model, query, time.Now().Unix()).Scan(&embedding)
+	if err == pgx.ErrNoRows {
+		return nil, false, nil
+	} else if err != nil {
+		logError(logger, "query row failed", err)
+		return nil, false, err
+	}
+
+	return embedding.Slice(), true, nil
+}
+
+func cacheQueryEmbedding(userID int, model, query string, embedding []float32) error {
+	logger := slog.Default().With("func", "cacheQueryEmbedding", "userID", userID)
+	defer logger.Info("query")
+
+	sql := `
+    INSERT INTO query_embeddings (user_id, model, query, embedding, time_used) VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (user_id, model, query) DO UPDATE SET embedding = EXCLUDED.embedding, time_used = EXCLUDED.time_used`
+
+	_, err := db.Exec(context.Background(), sql, userID, model, query, pgvector.NewVector(embedding), time.Now().Unix())
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+
+	return nil
+}
+
+func pruneQueryEmbeddings(usedBefore int64) (int64, error) {
+	logger := slog.Default().With("func", "pruneQueryEmbeddings")
+	defer logger.Info("query")
+
+	tag, err := db.Exec(context.Background(), `DELETE FROM query_embeddings WHERE time_used < $1`, usedBefore)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// getPostsVersion returns a number which changes whenever any of the user's posts are
+// saved, changed or deleted, see migrations/015_query_cache.sql.
+func getPostsVersion(userID int) (int64, error) {
+	logger := slog.Default().With("func", "getPostsVersion", "userID", userID)
+	defer logger.Info("query")
+
+	var version int64
+	err := db.QueryRow(context.Background(), `SELECT posts_version FROM users WHERE id = $1`, userID).Scan(&version)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// recordEmbeddingUsage adds the tokens of one embeddings request to the user's usage
+// for the day, given as YYYY-MM-DD.
+func recordEmbeddingUsage(userID int, day string, tokens int) error {
+	logger := slog.Default().With("func", "recordEmbeddingUsage", "userID", userID, "tokens", tokens)
+	defer logger.Info("query")
+
+	sql := `
+    INSERT INTO embedding_usage (user_id, day, tokens, requests) VALUES ($1, $2::date, $3, 1)
+    ON CONFLICT (user_id, day) DO UPDATE
+    SET tokens = embedding_usage.tokens + EXCLUDED.tokens, requests = embedding_usage.requests + 1`
+
+	_, err := db.Exec(context.Background(), sql, userID, day, tokens)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+
+	return nil
+}
+
+func getEmbeddingTokensUsed(userID int, day string) (int64, error) {
+	logger := slog.Default().With("func", "getEmbeddingTokensUsed", "userID", userID)
+	defer logger.Info("query")
+
+	var tokens int64
+	err := db.QueryRow(context.Background(), `
+    SELECT COALESCE(SUM(tokens), 0) FROM embedding_usage WHERE user_id = $1 AND day = $2::date`,
+		userID, day).Scan(&tokens)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return 0, err
+	}
+
+	return tokens, nil
+}
+
+type EmbeddingUsage struct {
+	Day      time.Time
+	Email    string
+	Tokens   int64
+	Requests int
+}
+
+// getEmbeddingUsage returns the usage of every user on every day since the given
+// one, latest day and biggest users first.
+func getEmbeddingUsage(sinceDay string) ([]EmbeddingUsage, error) {
+	logger := slog.Default().With("func", "getEmbeddingUsage", "since", sinceDay)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT u.day, users.email, u.tokens, u.requests
+    FROM embedding_usage u
+    JOIN users ON users.id = u.user_id
+    WHERE u.day >= $1::date
+    ORDER BY u.day DESC, u.tokens DESC`
+
+	rows, err := db.Query(context.Background(), sql, sinceDay)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+
+	usage, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (EmbeddingUsage, error) {
+		var u EmbeddingUsage
+		err := row.Scan(&u.Day, &u.Email, &u.Tokens, &u.Requests)
+		return u, err
+	})
+	if err != nil {
+		logError(logger, "failed to collect rows", err)
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// getEmbeddingSpaces returns the space search uses, and the one posts are being
+// re-embedded into if there is one.
+func getEmbeddingSpaces() (embeddingSpace, *embeddingSpace, error) {
+	logger := slog.Default().With("func", "getEmbeddingSpaces")
+	defer logger.Info("query")
+
+	var active embeddingSpace
+	var nextModel *string
+	var nextDimensions *int
+	err := db.QueryRow(context.Background(), `
+    SELECT model, dimensions, next_model, next_dimensions FROM embedding_config`).
+		Scan(&active.Model, &active.Dimensions, &nextModel, &nextDimensions)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return embeddingSpace{}, nil, err
+	}
+
+	if nextModel == nil || nextDimensions == nil {
+		return active, nil, nil
+	}
+	return active, &embeddingSpace{Model: *nextModel, Dimensions: *nextDimensions}, nil
+}
+
+// startEmbeddingMigration adds the columns posts are re-embedded into, dropping those
+// of an earlier unfinished migration.
+func startEmbeddingMigration(next embeddingSpace) error {
+	logger := slog.Default().With("func", "startEmbeddingMigration", "next", next)
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, sql := range []string{
+		dropNextEmbeddingColumns,
+		fmt.Sprintf(`ALTER TABLE posts ADD COLUMN embedding_next vector(%d), ADD COLUMN embedding_next_model TEXT,
+            ADD COLUMN embedding_next_dimensions INTEGER`, next.Dimensions),
+	} {
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			logError(logger, "query exec failed", err, "sql", sql)
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE embedding_config SET next_model = $1, next_dimensions = $2`, next.Model, next.Dimensions)
+	if err != nil {
+		logError(logger, "failed to update embedding config", err)
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logError(logger, "failed to commit transaction", err)
+		return err
+	}
+
+	return nil
+}
+
+const dropNextEmbeddingColumns = `
+    ALTER TABLE posts DROP COLUMN IF EXISTS embedding_next, DROP COLUMN IF EXISTS embedding_next_model,
+        DROP COLUMN IF EXISTS embedding_next_dimensions`
+
+// abandonEmbeddingMigration drops a migration which is no longer wanted.
+func abandonEmbeddingMigration() error {
+	logger := slog.Default().With("func", "abandonEmbeddingMigration")
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, sql := range []string{
+		dropNextEmbeddingColumns,
+		`UPDATE embedding_config SET next_model = NULL, next_dimensions = NULL`,
+	} {
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			logError(logger, "query exec failed", err, "sql", sql)
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logError(logger, "failed to commit transaction", err)
+		return err
+	}
+
+	return nil
+}
+
+func setPostNextEmbedding(postID int, space embeddingSpace, embedding []float32) error {
+	logger := slog.Default().With("func", "setPostNextEmbedding", "postID", postID)
+	defer logger.Info("query")
+
+	_, err := db.Exec(context.Background(), `
+    UPDATE posts SET embedding_next = $1, embedding_next_model = $3, embedding_next_dimensions = $4 WHERE id = $2`,
+		pgvector.NewVector(embedding), postID, space.Model, space.Dimensions)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+	return nil
+}
+
+// getPostsToReembed returns up to limit posts with ids above afterID which have an
+// embedding but not one in the space being migrated to.
+func getPostsToReembed(afterID, limit int) ([]Post, error) {
+	logger := slog.Default().With("func", "getPostsToReembed", "afterID", afterID)
+	defer logger.Info("query")
+
+	sql := `
+    SELECT id, user_id, url, title, body
+    FROM posts
+    WHERE id > $1 AND embedding IS NOT NULL AND embedding_next IS NULL
+    ORDER BY id
+    LIMIT $2`
+
+	rows, err := db.Query(context.Background(), sql, afterID, limit)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+
+	posts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Post, error) {
+		var post Post
+		err := row.Scan(&post.ID, &post.UserID, &post.URL, &post.Title, &post.Body)
+		return post, err
+	})
+	if err != nil {
+		logError(logger, "failed to collect rows", err)
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+// getReembedProgress returns how many of the posts with embeddings have been
+// re-embedded, and how many posts have embeddings.
+func getReembedProgress() (done, total int, err error) {
+	logger := slog.Default().With("func", "getReembedProgress")
+	defer logger.Info("query")
+
+	err = db.QueryRow(context.Background(), `
+    SELECT count(embedding_next), count(*) FROM posts WHERE embedding IS NOT NULL`).Scan(&done, &total)
+	if err != nil {
+		logError(logger, "query row failed", err)
+		return 0, 0, err
+	}
+
+	return done, total, nil
+}
+
+var errReembedIncomplete = errors.New("not every post has been re-embedded")
+
+// buildNextEmbeddingIndex builds the search index of the embeddings being migrated
+// to, without blocking writes to posts.
+func buildNextEmbeddingIndex() error {
+	logger := slog.Default().With("func", "buildNextEmbeddingIndex")
+	defer logger.Info("query")
+
+	// an interrupted concurrent build leaves an invalid index behind
+	for _, sql := range []string{
+		`DROP INDEX IF EXISTS posts_embedding_next_idx`,
+		`CREATE INDEX CONCURRENTLY posts_embedding_next_idx ON posts USING hnsw (embedding_next vector_ip_ops)`,
+	} {
+		if _, err := db.Exec(context.Background(), sql); err != nil {
+			logError(logger, "query exec failed", err, "sql", sql)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cutOverEmbeddings replaces the embeddings with the ones being migrated to, in one
+// transaction so searches see either the old embeddings or the new ones. Only column
+// renames happen while posts is locked, the data and index are already in place.
+// Fails with errReembedIncomplete if some post hasn't been re-embedded.
+func cutOverEmbeddings() error {
+	logger := slog.Default().With("func", "cutOverEmbeddings")
+	defer logger.Info("query")
+
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		logError(logger, "failed to begin transaction", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// block writes to posts while checking every post has a new embedding. Reads go on
+	// until the columns are dropped and renamed below, which lock out reads too, until
+	// the transaction commits.
+	if _, err := tx.Exec(ctx, `LOCK TABLE posts IN EXCLUSIVE MODE`); err != nil {
+		logError(logger, "failed to lock posts", err)
+		return err
+	}
+
+	var missing int
+	err = tx.QueryRow(ctx, `SELECT count(*) FROM posts WHERE embedding IS NOT NULL AND embedding_next IS NULL`).Scan(&missing)
+	if err != nil {
+		logError(logger, "failed to count posts missing embeddings", err)
+		return err
+	}
+	if missing > 0 {
+		return errReembedIncomplete
+	}
+
+	// triggers watching the embedding column, like posts_version_update from migration
+	// 015, can't outlive it. They're dropped and created again from their own
+	// definitions, which then refer to the renamed new column.
+	rows, err := tx.Query(ctx, `
+    SELECT t.tgname, pg_get_triggerdef(t.oid)
+    FROM pg_trigger t JOIN pg_attribute a ON a.attrelid = t.tgrelid AND a.attname = 'embedding'
+    WHERE t.tgrelid = 'posts'::regclass AND NOT t.tgisinternal AND a.attnum = ANY(t.tgattr)`)
+	if err != nil {
+		logError(logger, "failed to get embedding triggers", err)
+		return err
+	}
+	triggers, err := pgx.CollectRows(rows, pgx.RowToStructByPos[struct {
+		Name       string
+		Definition string
+	}])
+	if err != nil {
+		logError(logger, "failed to collect embedding triggers", err)
+		return err
+	}
+
+	var drops, creates []string
+	for _, trigger := range triggers {
+		drops = append(drops, fmt.Sprintf(`DROP TRIGGER %v ON posts`, pgx.Identifier{trigger.Name}.Sanitize()))
+		creates = append(creates, trigger.Definition)
+	}
+
+	swap := []string{
+		`ALTER TABLE posts DROP COLUMN embedding, DROP COLUMN embedding_model, DROP COLUMN embedding_dimensions`,
+		`ALTER TABLE posts RENAME COLUMN embedding_next TO embedding`,
+		`ALTER TABLE posts RENAME COLUMN embedding_next_model TO embedding_model`,
+		`ALTER TABLE posts RENAME COLUMN embedding_next_dimensions TO embedding_dimensions`,
+		`ALTER INDEX posts_embedding_next_idx RENAME TO posts_embedding_idx`,
+	}
+	after := []string{
+		`UPDATE embedding_config SET model = next_model, dimensions = next_dimensions,
+            next_model = NULL, next_dimensions = NULL`,
+		// every user's related posts, topics and search results change
+		`UPDATE users SET library_version = library_version + 1, posts_version = posts_version + 1`,
+	}
+
+	for _, sql := range slices.Concat(drops, swap, creates, after) {
+		if _, err := tx.Exec(ctx, sql); err != nil {
+			logError(logger, "query exec failed", err, "sql", sql)
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logError(logger, "failed to commit transaction", err)
+		return err
+	}
+
+	return nil
+}
+
+var errDuplicateSavedSearch = errors.New("saved search name taken")
+
+// createSavedSearch saves the search under the name and returns its id.
+func createSavedSearch(userID int, name string, search Search) (int, error) {
+	logger := slog.Default().With("func", "createSavedSearch", "userID", userID)
+	defer logger.Info("query")
+
+	var id int
+	err := db.QueryRow(context.Background(), `
+    INSERT INTO saved_searches (user_id, name, query, mode, state, length, time_created)
+    VALUES ($1, $2, $3, $4, $5, $6, extract(epoch from now())::bigint)
+    RETURNING id`,
+		userID, name, search.Query, search.Mode, search.State.Key, search.Length.Key).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, errDuplicateSavedSearch
+	} else if err != nil {
+		logError(logger, "query failed", err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func scanSavedSearch(row pgx.Row) (SavedSearch, error) {
+	var s SavedSearch
+	var state, length string
+	err := row.Scan(&s.ID, &s.Name, &s.Search.Query, &s.Search.Mode, &state, &length)
+	s.Search.State = getSearchState(state)
+	s.Search.Length = getLengthFilter(length)
+	return s, err
+}
+
+// getSavedSearches returns the user's saved searches by name.
+func getSavedSearches(userID int) ([]SavedSearch, error) {
+	logger := slog.Default().With("func", "getSavedSearches", "userID", userID)
+	defer logger.Info("query")
+
+	rows, err := db.Query(context.Background(), `
+    SELECT id, name, query, mode, state, length FROM saved_searches
+    WHERE user_id = $1
+    ORDER BY lower(name)`, userID)
+	if err != nil {
+		logError(logger, "query failed", err)
+		return nil, err
+	}
+
+	searches, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (SavedSearch, error) {
+		return scanSavedSearch(row)
+	})
+	if err != nil {
+		logError(logger, "failed to collect rows", err)
+		return nil, err
+	}
+
+	return searches, nil
+}
+
+// getSavedSearch returns one of the user's saved searches, pgx.ErrNoRows if they have
+// none with the id.
+func getSavedSearch(userID, id int) (SavedSearch, error) {
+	logger := slog.Default().With("func", "getSavedSearch", "userID", userID, "id", id)
+	defer logger.Info("query")
+
+	search, err := scanSavedSearch(db.QueryRow(context.Background(), `
+    SELECT id, name, query, mode, state, length FROM saved_searches
+    WHERE user_id = $1 AND id = $2`, userID, id))
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		logError(logger, "query failed", err)
+	}
+
+	return search, err
+}
+
+// deleteSavedSearch deletes one of the user's saved searches, pgx.ErrNoRows if they
+// have none with the id.
+func deleteSavedSearch(userID, id int) error {
+	logger := slog.Default().With("func", "deleteSavedSearch", "userID", userID, "id", id)
+	defer logger.Info("query")
+
+	tag, err := db.Exec(context.Background(), `DELETE FROM saved_searches WHERE user_id = $1 AND id = $2`, userID, id)
+	if err != nil {
+		logError(logger, "query exec failed", err)
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
 	return nil
 }
@@ -0,0 +1,81 @@
+package main
+
+import "strings"
+
+type DiffLine struct {
+	Op   string // "+", "-" or "" for unchanged lines
+	Text string
+}
+
+// past this many cells in the lcs table we don't bother diffing and show the whole
+// text as replaced
+const maxDiffCells = 4_000_000
+
+// diffText returns a line based diff between two texts, computed from the longest
+// common subsequence of their lines.
+func diffText(a, b string) []DiffLine {
+	aLines := splitDiffLines(a)
+	bLines := splitDiffLines(b)
+	n, m := len(aLines), len(bLines)
+
+	if n*m > maxDiffCells {
+		diff := make([]DiffLine, 0, n+m)
+		for _, line := range aLines {
+			diff = append(diff, DiffLine{Op: "-", Text: line})
+		}
+		for _, line := range bLines {
+			diff = append(diff, DiffLine{Op: "+", Text: line})
+		}
+		return diff
+	}
+
+	// lcs[i][j] is the length of the lcs of aLines[i:] and bLines[j:]
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []DiffLine
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case aLines[i] == bLines[j]:
+			diff = append(diff, DiffLine{Text: aLines[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{Op: "-", Text: aLines[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Op: "+", Text: bLines[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		diff = append(diff, DiffLine{Op: "-", Text: aLines[i]})
+	}
+	for ; j < m; j++ {
+		diff = append(diff, DiffLine{Op: "+", Text: bLines[j]})
+	}
+
+	return diff
+}
+
+func splitDiffLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
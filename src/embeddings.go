@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
@@ -14,11 +15,37 @@ import (
 var client *openai.Client
 
 func initOpenaiClient() {
-	apiKey := os.Getenv("LS2_OPENAI_KEY")
-	client = openai.NewClient(apiKey)
+	client = newOpenAIClient(os.Getenv("LS2_OPENAI_KEY"), os.Getenv("LS2_OPENAI_BASE_URL"))
 }
 
-const maxCharsPerChunk = 16384
+// newOpenAIClient returns a client for the OpenAI api, or for an OpenAI compatible
+// server such as a local model if baseURL is set.
+func newOpenAIClient(apiKey, baseURL string) *openai.Client {
+	config := openai.DefaultConfig(apiKey)
+	if baseURL != "" {
+		config.BaseURL = baseURL
+	}
+	return openai.NewClientWithConfig(config)
+}
+
+// embeddingSpace is an embedding model with the number of dimensions it's asked for.
+// Embeddings from different spaces can't be compared.
+type embeddingSpace struct {
+	Model      string
+	Dimensions int
+}
+
+func (s embeddingSpace) String() string {
+	return fmt.Sprintf("%v/%v", s.Model, s.Dimensions)
+}
+
+// default dimensions of the models we know, which aren't sent with requests so that
+// models without a dimensions option still work
+var defaultEmbeddingDimensions = map[string]int{
+	string(openai.SmallEmbedding3): 1536,
+	string(openai.LargeEmbedding3): 3072,
+	string(openai.AdaEmbeddingV2):  1536,
+}
 
 func normalize(vec []float32) {
 	sum := 0.0
@@ -31,24 +58,20 @@ func normalize(vec []float32) {
 	}
 }
 
-func getEmbedding(content string) ([]float32, error) {
-	chunks := splitIntoChunks(content, maxCharsPerChunk)
-	var combinedEmbedding []float32
-
-	for _, chunk := range chunks {
-		resp, err := client.CreateEmbeddings(context.Background(), openai.EmbeddingRequest{
-			Model: openai.SmallEmbedding3,
-			Input: chunk,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to create embedding: %w", err)
-		}
-
-		if len(resp.Data) == 0 {
-			return nil, fmt.Errorf("no embedding returned")
-		}
+// getEmbedding embeds content on behalf of a user, combining the embeddings of its
+// chunks if it's too long for one.
+func getEmbedding(userID int, space embeddingSpace, content string) ([]float32, error) {
+	embeddings, err := embedTexts(userID, space, chunkerForSpace(space).split(content))
+	if err != nil {
+		return nil, err
+	}
+	return combineEmbeddings(embeddings), nil
+}
 
-		embedding := resp.Data[0].Embedding
+// combineEmbeddings returns the normalized sum of the embeddings, nil if there are none.
+func combineEmbeddings(embeddings [][]float32) []float32 {
+	var combinedEmbedding []float32
+	for _, embedding := range embeddings {
 		if combinedEmbedding == nil {
 			combinedEmbedding = make([]float32, len(embedding))
 		}
@@ -58,72 +81,100 @@ func getEmbedding(content string) ([]float32, error) {
 		}
 	}
 
-	normalize(combinedEmbedding)
+	if combinedEmbedding != nil {
+		normalize(combinedEmbedding)
+	}
 
-	return combinedEmbedding, nil
+	return combinedEmbedding
 }
 
-func splitIntoChunks(s string, chunkSize int) []string {
-	var chunks []string
-	for start := 0; start < len(s); start += chunkSize {
-		end := start + chunkSize
-		if end > len(s) {
-			end = len(s)
-		}
-		chunks = append(chunks, s[start:end])
+// saveEmbedding computes and stores the embedding of a post, returning it or nil if
+// that failed. While the posts are being re-embedded with a new model, the post is
+// also embedded with that one in the background, which isn't counted towards the
+// user's usage.
+func saveEmbedding(post Post) []float32 {
+	active, next := embeddingSpaces()
+	if next != nil {
+		go saveNextEmbedding(post, *next)
+	}
+
+	embedding, err := embedPost(post.UserID, post, active)
+	if err != nil {
+		slog.Error("failed to get post embedding", "postID", post.ID, "error", err)
+		return nil
 	}
-	return chunks
+
+	// if search was cut over meanwhile, the embedding in the next space is the one kept
+	err = storePostEmbedding(post.ID, active, embedding)
+	if err != nil {
+		slog.Error("failed to set post embedding", "postID", post.ID, "error", err)
+		return nil
+	} else {
+		slog.Info("saved post embedding", "postID", post.ID)
+	}
+
+	return embedding
 }
 
-func saveEmbedding(post Post) {
-	errs := make(chan error, 3)
-
-	var titleEmbedding []float32
-	var urlEmbedding []float32
-	var bodyEmbedding []float32
-
-	go func() {
-		var err error
-		titleEmbedding, err = getEmbedding(post.Title)
-		errs <- err
-	}()
-	go func() {
-		var err error
-		urlEmbedding, err = getEmbedding(post.URL)
-		errs <- err
-	}()
-	go func() {
-		var err error
-		bodyEmbedding, err = getEmbedding(post.Body)
-		errs <- err
-	}()
-
-	for range 3 {
-		err := <-errs
-		if err != nil {
-			slog.Error("failed to get post embedding", "error", err)
-			return
-		}
+// saveNextEmbedding computes and stores the embedding of a post in the space posts are
+// being re-embedded into. If this fails the re-embedding worker gets to the post later.
+func saveNextEmbedding(post Post, next embeddingSpace) {
+	embedding, err := embedPost(systemUserID, post, next)
+	if err == nil {
+		err = storePostEmbedding(post.ID, next, embedding)
+	}
+	if err != nil {
+		slog.Error("failed to set post embedding with next model", "postID", post.ID, "error", err)
 	}
+}
+
+// embedPost returns the embedding of a post in the space, counting the tokens
+// towards userID's usage. The title, url and body are embedded in one request and
+// weighted. The body is embedded as markdown, which keeps its paragraphs for chunking
+// without spending tokens on html.
+func embedPost(userID int, post Post, space embeddingSpace) ([]float32, error) {
+	parts := []string{post.Title, post.URL, htmlToMarkdown(post.Body)}
+	weights := []float32{0.25, 0.15, 0.6}
 
-	embedding := make([]float32, len(bodyEmbedding))
-	for i := range embedding {
-		embedding[i] = 0.25*titleEmbedding[i] + 0.15*urlEmbedding[i] + 0.6*bodyEmbedding[i]
+	// the chunks of all the parts, and where each part's chunks start
+	chunker := chunkerForSpace(space)
+	var chunks []string
+	starts := make([]int, len(parts)+1)
+	for i, part := range parts {
+		starts[i] = len(chunks)
+		chunks = append(chunks, chunker.split(part)...)
 	}
-	normalize(embedding)
+	starts[len(parts)] = len(chunks)
 
-	err := setPostEmbedding(post.ID, embedding)
+	chunkEmbeddings, err := embedTexts(userID, space, chunks)
 	if err != nil {
-		slog.Error("failed to set post embedding", "error", err)
-		return
-	} else {
-		slog.Info("saved post embedding", "postID", post.ID)
+		return nil, err
+	}
+
+	var embedding []float32
+	for i := range parts {
+		partEmbedding := combineEmbeddings(chunkEmbeddings[starts[i]:starts[i+1]])
+		if partEmbedding == nil {
+			continue
+		}
+		if embedding == nil {
+			embedding = make([]float32, len(partEmbedding))
+		}
+		for j := range embedding {
+			embedding[j] += weights[i] * partEmbedding[j]
+		}
 	}
+	if embedding == nil {
+		return nil, errors.New("post has nothing to embed")
+	}
+	normalize(embedding)
+
+	return embedding, nil
 }
 
 func generateEmbeddingsForExistingPosts() error {
 	query := `
-    SELECT id, url, title, body
+    SELECT id, user_id, url, title, body
     FROM posts;
     `
 
@@ -135,7 +186,7 @@ func generateEmbeddingsForExistingPosts() error {
 
 	for rows.Next() {
 		var post Post
-		err := rows.Scan(&post.ID, &post.URL, &post.Title, &post.Body)
+		err := rows.Scan(&post.ID, &post.UserID, &post.URL, &post.Title, &post.Body)
 		if err != nil {
 			log.Printf("query row scan failed: %v\n", err)
 			continue
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// An export is a zip with:
+//   - posts.json, every post with its metadata and html body
+//   - markdown/, every post converted to markdown with the metadata as front matter
+//   - html/ and index.html, a browsable archive of the posts
+//
+// Posts are streamed from the db twice (once for posts.json, once for the per post
+// files) so that nothing but the index is held in memory.
+
+type exportPost struct {
+	ID           int    `json:"id"`
+	URL          string `json:"url"`
+	Title        string `json:"title"`
+	State        string `json:"state"`
+	IsLiked      bool   `json:"is_liked"`
+	TimeAdded    string `json:"time_added,omitempty"`
+	TimeArchived string `json:"time_archived,omitempty"`
+	TimeLiked    string `json:"time_liked,omitempty"`
+	Byline       string `json:"byline,omitempty"`
+	SiteName     string `json:"site_name,omitempty"`
+	Published    string `json:"published,omitempty"`
+	Excerpt      string `json:"excerpt,omitempty"`
+	LeadImage    string `json:"lead_image,omitempty"`
+	WordCount    int    `json:"word_count,omitempty"`
+	Body         string `json:"body_html"`
+}
+
+type exportIndexEntry struct {
+	Post     Post
+	HTMLPath string
+	MDPath   string
+}
+
+func formatExportTime(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+func toExportPost(post Post) exportPost {
+	return exportPost{
+		ID:           post.ID,
+		URL:          post.URL,
+		Title:        post.Title,
+		State:        post.State,
+		IsLiked:      post.IsLiked,
+		TimeAdded:    formatExportTime(post.TimeAdded),
+		TimeArchived: formatExportTime(post.TimeArchived),
+		TimeLiked:    formatExportTime(post.TimeLiked),
+		Byline:       post.Byline,
+		SiteName:     post.SiteName,
+		Published:    formatExportTime(post.TimePublished),
+		Excerpt:      post.Excerpt,
+		LeadImage:    post.LeadImage,
+		WordCount:    post.WordCount,
+		Body:         post.Body,
+	}
+}
+
+func exportFileName() string {
+	return fmt.Sprintf("lucentsave-export-%v.zip", time.Now().UTC().Format("2006-01-02"))
+}
+
+// writeExport writes a zip archive of all the user's posts to w.
+func writeExport(w io.Writer, userID int) error {
+	zw := zip.NewWriter(w)
+
+	if err := writeExportJSON(zw, userID); err != nil {
+		return err
+	}
+
+	var index []exportIndexEntry
+	err := streamUserPosts(userID, func(post Post) error {
+		name := fmt.Sprintf("%d-%s", post.ID, slugify(post.Title))
+		entry := exportIndexEntry{HTMLPath: "html/" + name + ".html", MDPath: "markdown/" + name + ".md"}
+
+		f, err := zw.Create(entry.MDPath)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, postToMarkdown(post)); err != nil {
+			return err
+		}
+
+		f, err = zw.Create(entry.HTMLPath)
+		if err != nil {
+			return err
+		}
+		if err := exportPostTemplate.Execute(f, map[string]any{"Post": post, "Body": template.HTML(post.Body)}); err != nil {
+			return err
+		}
+
+		// only keep what the index needs
+		post.Body = ""
+		entry.Post = post
+		index = append(index, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := zw.Create("index.html")
+	if err != nil {
+		return err
+	}
+	if err := exportIndexTemplate.Execute(f, map[string]any{"Entries": index, "Date": time.Now().UTC().Format("2006-01-02")}); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// writeExportJSON streams the posts into posts.json as a json array.
+func writeExportJSON(zw *zip.Writer, userID int) error {
+	f, err := zw.Create("posts.json")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(f, "[\n"); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	first := true
+	err = streamUserPosts(userID, func(post Post) error {
+		if !first {
+			if _, err := io.WriteString(f, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		return enc.Encode(toExportPost(post))
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(f, "]\n")
+	return err
+}
+
+func postToMarkdown(post Post) string {
+	var sb strings.Builder
+	sb.WriteString("---\n")
+	fmt.Fprintf(&sb, "title: %q\n", post.Title)
+	fmt.Fprintf(&sb, "url: %q\n", post.URL)
+	fmt.Fprintf(&sb, "state: %v\n", post.State)
+	fmt.Fprintf(&sb, "liked: %v\n", post.IsLiked)
+	for _, field := range []struct{ key, value string }{
+		{"author", post.Byline}, {"site", post.SiteName}, {"excerpt", post.Excerpt}, {"image", post.LeadImage},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&sb, "%v: %q\n", field.key, field.value)
+		}
+	}
+	for _, t := range []struct {
+		key  string
+		unix int64
+	}{{"published", post.TimePublished}, {"added", post.TimeAdded}, {"archived_at", post.TimeArchived}, {"liked_at", post.TimeLiked}} {
+		if t.unix != 0 {
+			fmt.Fprintf(&sb, "%v: %v\n", t.key, formatExportTime(t.unix))
+		}
+	}
+	sb.WriteString("---\n\n")
+	fmt.Fprintf(&sb, "# %v\n\n", escapeMarkdown(post.Title))
+	sb.WriteString(htmlToMarkdown(post.Body))
+	return sb.String()
+}
+
+// slugify turns a title into something safe to use in a file name.
+func slugify(title string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+			dash = false
+		} else if !dash && sb.Len() > 0 {
+			sb.WriteRune('-')
+			dash = true
+		}
+		if sb.Len() >= 60 {
+			break
+		}
+	}
+
+	slug := strings.Trim(sb.String(), "-")
+	if slug == "" {
+		return "untitled"
+	}
+	return slug
+}
+
+var exportPostTemplate = template.Must(template.New("exportPost").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>{{.Post.Title}}</title>
+</head>
+<body>
+<p><a href="../index.html">Back to index</a></p>
+<h1>{{.Post.Title}}</h1>
+<p><a href="{{.Post.URL}}">{{.Post.URL}}</a></p>
+<article>
+{{.Body}}
+</article>
+</body>
+</html>
+`))
+
+var exportIndexTemplate = template.Must(template.New("exportIndex").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<title>Lucentsave export {{.Date}}</title>
+</head>
+<body>
+<h1>Lucentsave export {{.Date}}</h1>
+<ul>
+{{range .Entries}}<li><a href="{{.HTMLPath}}">{{.Post.Title}}</a> ({{.Post.State}}{{if .Post.IsLiked}}, liked{{end}}) - <a href="{{.MDPath}}">markdown</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
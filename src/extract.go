@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const nodeServerURL = "http://localhost:3000/process"
+
+const maxPostLength = 200000
+
+// how long we wait for the node server to accept connections at startup
+const nodeServerStartTimeout = 30 * time.Second
+
+// errExtractionFailed means the node server couldn't fetch or parse the page, as
+// opposed to us failing to talk to the node server at all.
+var errExtractionFailed = errors.New("article extraction failed")
+
+var errPostTooLong = errors.New("post too long")
+
+type Article struct {
+	Title         string `json:"title"`
+	Content       string `json:"content"`
+	CanonicalURL  string `json:"canonicalUrl"`
+	Byline        string `json:"byline"`
+	PublishedTime string `json:"publishedTime"`
+	SiteName      string `json:"siteName"`
+	Excerpt       string `json:"excerpt"`
+	LeadImage     string `json:"leadImage"`
+}
+
+const (
+	maxBylineLength   = 200
+	maxSiteNameLength = 200
+	maxExcerptLength  = 500
+)
+
+// Metadata cleans up the metadata the node server found for the article. Sites put
+// all sorts of things in their meta tags, so everything is treated as untrusted text.
+func (a Article) Metadata() PostMetadata {
+	meta := PostMetadata{
+		Byline:        truncateText(a.Byline, maxBylineLength),
+		SiteName:      truncateText(a.SiteName, maxSiteNameLength),
+		Excerpt:       truncateText(a.Excerpt, maxExcerptLength),
+		TimePublished: parseTimestamp(a.PublishedTime),
+	}
+
+	if leadImage, ok := sanitizeURL(a.LeadImage, false); ok && isUrl(leadImage) {
+		meta.LeadImage = leadImage
+	}
+
+	return meta
+}
+
+// truncateText collapses whitespace and cuts s to at most n bytes without splitting
+// a utf-8 sequence.
+func truncateText(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return strings.TrimSpace(s) + "…"
+}
+
+// waitForNodeServer waits until the node server accepts connections, or fails after
+// timeout.
+func waitForNodeServer(timeout time.Duration) error {
+	nodeURL, err := url.Parse(nodeServerURL)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", nodeURL.Host, time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// extractArticle has the node server fetch url and run it through readability.
+func extractArticle(url string) (Article, error) {
+	reqBody, err := json.Marshal(map[string]string{"url": url})
+	if err != nil {
+		return Article{}, err
+	}
+
+	nodeResp, err := http.Post(nodeServerURL, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return Article{}, fmt.Errorf("failed to fetch from node server: %w", err)
+	}
+	defer nodeResp.Body.Close()
+
+	if nodeResp.StatusCode != http.StatusOK {
+		return Article{}, errExtractionFailed
+	}
+
+	var article Article
+	if err := json.NewDecoder(nodeResp.Body).Decode(&article); err != nil {
+		return Article{}, fmt.Errorf("failed to decode node server response: %w", err)
+	}
+
+	totalLength := len(article.Title) + len(url) + len(article.Content)
+	if totalLength > maxPostLength {
+		return Article{}, fmt.Errorf("%w: %d chars", errPostTooLong, totalLength)
+	}
+
+	return article, nil
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/mail"
 	"net/url"
-	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -20,37 +24,62 @@ import (
 func addHandleFuncs() {
 	// static stuff
 	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/static/", http.StripPrefix("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("GET /static/", http.StripPrefix("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		writeCacheHeader(maxCacheTimeout, w)
 		fs.ServeHTTP(w, r)
 	})))
-	http.Handle("/favicon.ico", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("GET /favicon.ico", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		writeCacheHeader(maxCacheTimeout, w)
 		http.ServeFile(w, r, "static/favicon.ico")
 	}))
 
 	// POST
-	http.HandleFunc("/mark-liked", authMiddleware(markLikedHandler))
-	http.HandleFunc("/mark-read", authMiddleware(markReadHandler))
-	http.HandleFunc("/update-post-state", authMiddleware(updatePostStateHandler))
-	http.HandleFunc("/save", authMiddleware(savePostHandler))
-	http.HandleFunc("/delete-post", authMiddleware(deletePostHandler))
-	http.HandleFunc("/create-user", createUserHandler) // registration attempt
-	http.HandleFunc("/signout", signoutHandler)          // sign out endpoint
+	http.HandleFunc("POST /mark-liked", authMiddleware(markLikedHandler))
+	http.HandleFunc("POST /mark-read", authMiddleware(markReadHandler))
+	http.HandleFunc("POST /update-post-state", authMiddleware(updatePostStateHandler))
+	http.HandleFunc("POST /post-progress", authMiddleware(postProgressHandler))
+	http.HandleFunc("POST /save", authMiddleware(savePostHandler))
+	http.HandleFunc("POST /delete-post", authMiddleware(deletePostHandler))
+	http.HandleFunc("POST /restore-post", authMiddleware(restorePostHandler))
+	http.HandleFunc("POST /delete-post-forever", authMiddleware(deletePostForeverHandler))
+	http.HandleFunc("POST /empty-trash", authMiddleware(emptyTrashHandler))
+	http.HandleFunc("POST /query", authMiddleware(queryHandler))
+	http.HandleFunc("POST /import", authMiddleware(importHandler))
+	http.HandleFunc("POST /delete-account", authMiddleware(deleteAccountHandler))
+	http.HandleFunc("POST /summary-settings", authMiddleware(summarySettingsHandler))
+	http.HandleFunc("POST /refetch-post", authMiddleware(refetchPostHandler))
+	http.HandleFunc("POST /add-tag", authMiddleware(addTagHandler))
+	http.HandleFunc("POST /remove-tag", authMiddleware(removeTagHandler))
+	http.HandleFunc("POST /save-search", authMiddleware(saveSearchHandler))
+	http.HandleFunc("POST /delete-saved-search", authMiddleware(deleteSavedSearchHandler))
+	http.HandleFunc("POST /create-user", createUserHandler)    // registration attempt
+	http.HandleFunc("POST /authenticate", authenticateHandler) // sign in attempt
+	http.HandleFunc("POST /signout", signoutHandler)           // sign out endpoint
+	http.HandleFunc("POST /csp-report", cspReportHandler)      // browser csp violation reports
 
 	// GET
-	http.HandleFunc("/post", authMiddleware(postStaticHandler))
-	http.HandleFunc("/post-status", authMiddleware(postStatusHandler))
-	http.HandleFunc("/fetch-url", authMiddleware(fetchURL))
-	http.HandleFunc("/saved", authMiddleware(getPostListHandler("/saved")))
-	http.HandleFunc("/read", authMiddleware(getPostListHandler("/read")))
-	http.HandleFunc("/search", authMiddleware(getPostListHandler("/search")))
-	http.HandleFunc("/query", authMiddleware(queryHandler))
-	http.HandleFunc("/", redirectIfSignedInMiddelware(signinPageHandler))           // sign in page
-	http.HandleFunc("/signin", redirectIfSignedInMiddelware(signinPageHandler))     // sign in page
-	http.HandleFunc("/register", redirectIfSignedInMiddelware(registerPageHandler)) // registration page
-	http.HandleFunc("/authenticate", authenticateHandler)                           // sign in attempt
-	http.HandleFunc("/privacy-policy", privacyPolicyHandler)                        // privacy policy static page for chrome extension store...
+	http.HandleFunc("GET /post", authMiddleware(postStaticHandler))
+	http.HandleFunc("GET /post-status", authMiddleware(postStatusHandler))
+	http.HandleFunc("GET /related-posts", authMiddleware(relatedPostsHandler))
+	http.HandleFunc("GET /post-history", authMiddleware(postHistoryHandler))
+	http.HandleFunc("GET /fetch-url", authMiddleware(fetchURL))
+	http.HandleFunc("GET /saved", authMiddleware(getPostListHandler("/saved")))
+	http.HandleFunc("GET /read", authMiddleware(getPostListHandler("/read")))
+	http.HandleFunc("GET /search", authMiddleware(getPostListHandler("/search")))
+	http.HandleFunc("GET /ask", authMiddleware(askHandler))
+	http.HandleFunc("GET /query", authMiddleware(queryHandler)) // the search page uses GET so results can be revalidated
+	http.HandleFunc("GET /trash", authMiddleware(getPostListHandler("/trash")))
+	http.HandleFunc("GET /topics", authMiddleware(topicsHandler))
+	http.HandleFunc("GET /saved-search", authMiddleware(savedSearchHandler))
+	http.HandleFunc("GET /saved-searches", authMiddleware(savedSearchesHandler))
+	http.HandleFunc("GET /import", authMiddleware(importPageHandler))
+	http.HandleFunc("GET /import-status", authMiddleware(importStatusHandler))
+	http.HandleFunc("GET /export", authMiddleware(exportHandler))
+	http.HandleFunc("GET /account", authMiddleware(accountPageHandler))
+	http.HandleFunc("GET /{$}", redirectIfSignedInMiddelware(signinPageHandler))        // sign in page
+	http.HandleFunc("GET /signin", redirectIfSignedInMiddelware(signinPageHandler))     // sign in page
+	http.HandleFunc("GET /register", redirectIfSignedInMiddelware(registerPageHandler)) // registration page
+	http.HandleFunc("GET /privacy-policy", privacyPolicyHandler)                        // privacy policy static page for chrome extension store...
 }
 
 func writeCacheHeader(duration int, w http.ResponseWriter) {
@@ -72,19 +101,14 @@ func respondBadRequest(w http.ResponseWriter) {
 }
 
 func signoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Clear the auth cookie by setting it to expire immediately
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		HttpOnly: true,
-		Secure:   os.Getenv("ENV") == "production",
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-	})
+	clearAuthToken(w)
 
 	// Redirect to signin page
-	http.Redirect(w, r, "/signin", http.StatusTemporaryRedirect)
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", "/signin")
+	} else {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+	}
 }
 
 func logAndRespondInternalError(logger *slog.Logger, msg string, w http.ResponseWriter, err error, attr ...any) {
@@ -100,30 +124,64 @@ func getPostListHandler(path string) http.HandlerFunc {
 		logger := slog.Default().With("func", "getPostListHandler", "path", path, "userID", userID)
 
 		var postEntries []Post
-		data := map[string]any{}
+		data := baseTemplateData(r, nil)
 		data["Path"] = path
 
+		opts := postListOptionsFromQuery(r.URL.Query())
+		data["Options"] = opts
+		data["Sorts"] = postSorts
+		data["LengthFilters"] = lengthFilters
+
+		cursor, err := decodeCursor(r.URL.Query().Get("cursor"), opts.sortKeys())
+		if err != nil {
+			http.Error(w, "Error: invalid cursor", http.StatusBadRequest)
+			return
+		}
+
+		var nextCursor string
 		switch path {
 		case "/saved":
-			postEntries = getUserPostsInfo(userID, false)
+			postEntries, nextCursor = getUserPostsInfo(userID, []string{stateInbox, stateReading}, opts, cursor)
 			data["Saved"] = true
 		case "/read":
-			postEntries = getUserPostsInfo(userID, true)
+			postEntries, nextCursor = getUserPostsInfo(userID, []string{stateArchived}, opts, cursor)
 			data["Read"] = true
+		case "/trash":
+			postEntries, nextCursor = getUserPostsInfo(userID, []string{stateTrashed}, opts, cursor)
+			data["Trash"] = true
+			data["TrashRetentionDays"] = int(trashRetention.Hours() / 24)
 		case "/search":
 			postEntries = []Post{}
 			data["Search"] = true
+			data["AskMode"] = r.URL.Query().Get("mode") == "ask"
+			data["FindMode"] = r.URL.Query().Get("mode") == searchModeFind
+			// a saved search opens here to be changed
+			data["SearchForm"] = searchFromForm(r.URL.Query())
+			data["SearchStates"] = searchStates
 		}
 
 		data["Posts"] = postEntries
+		if nextCursor != "" {
+			data["NextURL"] = path + "?" + opts.query(nextCursor).Encode()
+		}
 
 		w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+
+		// later pages are requested by the infinite scroll and only need the entries
+		if cursor != nil {
+			data["OOB"] = true
+			if err := postListTemplate.ExecuteTemplate(w, "postPage", data); err != nil {
+				logAndRespondInternalError(logger, "post page template error", w, err)
+			}
+			return
+		}
+
 		// var err error
 		// if r.Header.Get("HX-Request") == "true" {
 		// logAndRespondInternalError(logger, "hx-request in path?!", w, nil)
 		// return
 		// } else {
-		err := postListTemplate.ExecuteTemplate(w, "base", data)
+		err = postListTemplate.ExecuteTemplate(w, "base", data)
 		// }
 
 		if err != nil {
@@ -133,40 +191,282 @@ func getPostListHandler(path string) http.HandlerFunc {
 	}
 }
 
+// topicsHandler lists the user's topics, or the posts in one with ?id=.
+func topicsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIdFromRequest(r)
+
+	logger := slog.Default().With("func", "topicsHandler", "userID", userID)
+
+	data := baseTemplateData(r, nil)
+	data["Path"] = "/topics"
+
+	if r.URL.Query().Has("id") {
+		topicID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			respondBadRequest(w)
+			return
+		}
+		topic, posts, err := getTopicPosts(userID, topicID)
+		if err != nil {
+			http.Error(w, "Topic not found.", http.StatusNotFound)
+			return
+		}
+		data["Topic"] = topic
+		data["Posts"] = posts
+	} else {
+		topics, err := getTopics(userID)
+		if err != nil {
+			respondInternalError(w)
+			return
+		}
+		data["Topics"] = topics
+		data["MinPostsForTopics"] = minPostsForTopics
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	if err := postListTemplate.ExecuteTemplate(w, "base", data); err != nil {
+		logAndRespondInternalError(logger, "topics template error", w, err)
+	}
+}
+
 func queryHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
 	userID := getUserIdFromRequest(r)
 
-	if !r.Form.Has("query") {
+	search := searchFromForm(r.Form)
+	if search.IsEmpty() {
 		respondBadRequest(w)
 		return
 	}
 
-	query := r.Form.Get("query")
+	logger := slog.Default().With("func", "queryHandler", "userID", userID, "query", search.Query)
+
+	// results only change when the library does, so they can be revalidated without
+	// embedding the query or searching again
+	postsVersion, err := getPostsVersion(userID)
+	if err != nil {
+		respondInternalError(w)
+		return
+	}
+	etag := queryETag(userID, postsVersion, search)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		respondNotModified(w)
+		return
+	}
+
+	postEntries, fullText, err := searchPosts(userID, search, searchResultLimit, false)
+	if errors.Is(err, errEmbeddingQuotaExceeded) {
+		w.Header().Del("ETag")
+		http.Error(w, "Error: you've reached today's search limit, try again tomorrow.", http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		logAndRespondInternalError(logger, "failed to search posts", w, err)
+		return
+	}
+	// full text results would otherwise be revalidated in place of the semantic ones
+	// once the embeddings api is back, as the etag is the same
+	if fullText {
+		w.Header().Del("ETag")
+	}
+
+	err = postListTemplate.ExecuteTemplate(w, "postList", map[string][]Post{"Posts": postEntries})
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to execute search result postList template", w, err)
+		return
+	}
+
+}
 
-	if query == "" {
+func queryETag(userID int, postsVersion int64, search Search) string {
+	h := sha256.New()
+	fmt.Fprint(h, userID, postsVersion, currentEmbeddingSpace(), search.Values().Encode())
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+// saveSearchHandler saves the search in the form under its name and goes to it.
+func saveSearchHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	userID := getUserIdFromRequest(r)
+
+	name, ok := normalizeSavedSearchName(r.Form.Get("name"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("Error: names must be 1 to %v characters.", maxSavedSearchNameLength), http.StatusBadRequest)
+		return
+	}
+	search := searchFromForm(r.Form)
+	if search.IsEmpty() {
+		http.Error(w, "Error: enter a search or pick a filter to save.", http.StatusBadRequest)
+		return
+	}
+
+	id, err := createSavedSearch(userID, name, search)
+	if errors.Is(err, errDuplicateSavedSearch) {
+		http.Error(w, "Error: you already have a saved search with that name.", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		respondInternalError(w)
+		return
+	}
+
+	w.Header().Set("HX-Redirect", fmt.Sprintf("/saved-search?id=%v", id))
+}
+
+// savedSearchHandler lists the posts matching a saved search.
+func savedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIdFromRequest(r)
+
+	logger := slog.Default().With("func", "savedSearchHandler", "userID", userID)
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
 		respondBadRequest(w)
 		return
 	}
+	savedSearch, err := getSavedSearch(userID, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Saved search not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondInternalError(w)
+		return
+	}
+
+	data := baseTemplateData(r, nil)
+	data["Path"] = "/saved-search"
+	data["SavedSearch"] = savedSearch
+
+	posts, _, err := searchPosts(userID, savedSearch.Search, savedSearchLimit, true)
+	if errors.Is(err, errEmbeddingQuotaExceeded) {
+		data["SearchError"] = "You've reached today's search limit, try again tomorrow."
+	} else if err != nil {
+		respondInternalError(w)
+		return
+	}
+	data["Posts"] = posts
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	if err := postListTemplate.ExecuteTemplate(w, "base", data); err != nil {
+		logAndRespondInternalError(logger, "saved search template error", w, err)
+	}
+}
+
+// savedSearchesHandler renders the user's saved searches for the menu, with how many
+// posts match each.
+func savedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIdFromRequest(r)
+
+	logger := slog.Default().With("func", "savedSearchesHandler", "userID", userID)
+
+	searches, err := getSavedSearches(userID)
+	if err != nil {
+		respondInternalError(w)
+		return
+	}
 
-	logger := slog.Default().With("func", "queryHandler", "userID", userID, "query", query)
+	if err := countSavedSearches(userID, searches); err != nil {
+		// the searches are still listed, without counts
+		logger.Warn("failed to count saved searches", "error", err)
+	}
 
-	// postEntries := searchUserPosts(userID, query)
-	querryEmbedding, err := getEmbedding(query)
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	if err := postListTemplate.ExecuteTemplate(w, "savedSearches", map[string]any{"SavedSearches": searches}); err != nil {
+		logAndRespondInternalError(logger, "saved searches template error", w, err)
+	}
+}
+
+func deleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id, err := strconv.Atoi(r.Form.Get("id"))
 	if err != nil {
-		logAndRespondInternalError(logger, "failed to get query embedding", w, err)
+		respondBadRequest(w)
 		return
 	}
-	postEntries := searchUserPostsByEmbedding(userID, querryEmbedding)
 
-	// TODO: this might be a good spot to cache with etags, search is expensive..
-	err = postListTemplate.ExecuteTemplate(w, "postList", map[string][]Post{"Posts": postEntries})
+	err = deleteSavedSearch(getUserIdFromRequest(r), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Saved search not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondInternalError(w)
+		return
+	}
+	forgetSavedSearchCount(id)
+
+	w.Header().Set("HX-Redirect", "/search")
+}
+
+// askHandler answers a question from the user's library, streamed as server-sent
+// events: first "sources" with the numbered passages the answer cites, then "answer"
+// events with pieces of the answer text and finally "done", or "failure" with a
+// message if something went wrong.
+func askHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIdFromRequest(r)
+	question := strings.TrimSpace(r.URL.Query().Get("q"))
+	if question == "" || len([]rune(question)) > maxQuestionLength {
+		respondBadRequest(w)
+		return
+	}
+
+	logger := slog.Default().With("func", "askHandler", "userID", userID)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logAndRespondInternalError(logger, "response writer can't flush", w, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	// keep proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	send := func(event string, data any) error {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event, encoded); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	sources, err := findAskSources(userID, question)
+	if errors.Is(err, errEmbeddingQuotaExceeded) {
+		send("failure", "You've reached today's search limit, try again tomorrow.")
+		return
+	} else if err != nil {
+		logger.Error("failed to find passages for question", "error", err)
+		send("failure", "Failed to search your library.")
+		return
+	}
+	if len(sources) == 0 {
+		send("failure", "There's nothing in your library to answer from yet.")
+		return
+	}
+
+	if err := send("sources", sources); err != nil {
+		return
+	}
+
+	err = chatProvider.StreamChat(r.Context(), askMessages(question, sources), func(delta string) error {
+		return send("answer", delta)
+	})
 	if err != nil {
-		logAndRespondInternalError(logger, "failed to get execute search result postList template", w, err)
+		// the client going away cancels the request context
+		if r.Context().Err() == nil {
+			logger.Error("failed to answer question", "error", err)
+			send("failure", "Failed to get an answer.")
+		}
 		return
 	}
 
+	send("done", "")
 }
 
 func markLikedHandler(w http.ResponseWriter, r *http.Request) {
@@ -183,7 +483,7 @@ func markLikedHandler(w http.ResponseWriter, r *http.Request) {
 		isLiked = true
 	}
 
-	err = markPostLiked(postID, isLiked)
+	err = markPostLiked(postID, getUserIdFromRequest(r), isLiked)
 	if err != nil {
 		respondInternalError(w)
 		return
@@ -199,13 +499,16 @@ func markReadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isRead := false
+	// kept for the browser extension, read means archived
+	state := stateInbox
 	if r.Form.Has("read") {
-		isRead = true
+		state = stateArchived
 	}
 
-	err = markPostRead(postID, isRead)
-	if err != nil {
+	err = setPostState(postID, getUserIdFromRequest(r), state)
+	if errors.Is(err, errStateTransition) {
+		http.Error(w, "Error: can't move post to that state", http.StatusConflict)
+	} else if err != nil {
 		respondInternalError(w)
 	}
 }
@@ -220,83 +523,268 @@ func updatePostStateHandler(w http.ResponseWriter, r *http.Request) {
 
 	userID := getUserIdFromRequest(r)
 
-	isRead := r.FormValue("read") != ""
-	isLiked := r.FormValue("liked") != "" && isRead // Ensure isLiked is only true if isRead is also true
+	// state and liked are independent, either can be left out to keep it as is
+	if r.Form.Has("state") {
+		state := r.Form.Get("state")
+		if !isValidState(state) || state == stateTrashed {
+			respondBadRequest(w)
+			return
+		}
+
+		err = setPostState(postID, userID, state)
+		if errors.Is(err, errStateTransition) {
+			http.Error(w, "Error: can't move post to that state", http.StatusConflict)
+			return
+		} else if err != nil {
+			respondInternalError(w)
+			return
+		}
+	}
+
+	if r.Form.Has("liked") {
+		if err := markPostLiked(postID, userID, r.Form.Get("liked") == "true"); err != nil {
+			respondInternalError(w)
+			return
+		}
+	}
+}
 
-	err = updatePostStatus(postID, userID, isRead, isLiked)
+var progressAnchorRegex = regexp.MustCompile(`^[a-z0-9]{1,10}:[0-9]{1,6}$`)
+
+// postProgressHandler records how far the user has scrolled through a post. It's
+// called by the reader a little after scrolling stops and when the page is closed.
+// Starting a post moves it from the inbox to reading and getting to the end archives
+// it. The X-Post-State header has the state the post ends up in.
+func postProgressHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	postID, err := strconv.Atoi(r.Form.Get("id"))
 	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+
+	percent, err := strconv.ParseFloat(r.Form.Get("percent"), 64)
+	if err != nil || math.IsNaN(percent) {
+		respondBadRequest(w)
+		return
+	}
+	percent = min(max(percent, 0), 100)
+
+	anchor := r.Form.Get("anchor")
+	if anchor != "" && !progressAnchorRegex.MatchString(anchor) {
+		respondBadRequest(w)
+		return
+	}
+
+	userID := getUserIdFromRequest(r)
+
+	state, err := saveReadingProgress(postID, userID, percent, anchor)
+	if errors.Is(err, errStateTransition) {
+		// trashed or gone, nothing to keep track of
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
 		respondInternalError(w)
 		return
 	}
+
+	next := state
+	switch {
+	case percent >= 100 && (state == stateInbox || state == stateReading):
+		next = stateArchived
+	case percent > 0 && state == stateInbox:
+		next = stateReading
+	}
+	if next != state {
+		if err := setPostState(postID, userID, next); err != nil {
+			respondInternalError(w)
+			return
+		}
+	}
+
+	w.Header().Set("X-Post-State", next)
+	w.WriteHeader(http.StatusNoContent)
 }
 
+// savePostHandler saves the post at url, unless the user already has it in which case
+// the existing post is returned (moved back to unread if mark_unread is set).
 func savePostHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	url := r.Form.Get("url")
+	url := canonicalizeURL(r.Form.Get("url"))
+	markUnread := r.Form.Get("mark_unread") == "true"
 	userID := getUserIdFromRequest(r)
 	logger := slog.Default().With("func", "savePostHandler", "userID", userID)
 
-	// Fetch processed content from Node.js server
-	nodeResp, err := http.Post("http://localhost:3000/process", "application/json",
-		bytes.NewBufferString(`{"url":"`+url+`"}`))
+	// no need to extract articles we already have
+	existing, ok, err := findSavedPost(userID, url)
 	if err != nil {
-		logAndRespondInternalError(logger, "failed to fetch from Node server", w, err)
+		respondInternalError(w)
+		return
+	} else if ok {
+		respondWithSavedPost(w, existing, markUnread, logger)
 		return
 	}
-	defer nodeResp.Body.Close()
 
-	if nodeResp.StatusCode != http.StatusOK {
+	article, err := extractArticle(url)
+	if errors.Is(err, errExtractionFailed) || errors.Is(err, errPostTooLong) {
+		logger.Warn("failed to extract article", "url", url, "error", err)
 		respondBadRequest(w)
 		return
+	} else if err != nil {
+		logAndRespondInternalError(logger, "failed to extract article", w, err)
+		return
 	}
 
-	var articleData map[string]string
-	if err := json.NewDecoder(nodeResp.Body).Decode(&articleData); err != nil {
-		logAndRespondInternalError(logger, "failed to decode Node server response", w, err)
+	post := Post{URL: url, CanonicalURL: canonicalURLForArticle(url, article), Title: article.Title, Body: article.Content,
+		TimeAdded: time.Now().Unix(), UserID: userID, PostMetadata: article.Metadata()}
+	postID, err := savePost(post)
+	if errors.Is(err, errDuplicatePost) {
+		// the page's canonical url matched a post saved under a different url
+		existing, ok, err := findSavedPost(userID, post.CanonicalURL)
+		if err != nil || !ok {
+			respondInternalError(w)
+			return
+		}
+		respondWithSavedPost(w, existing, markUnread, logger)
+		return
+	} else if err != nil {
+		logger.Error("failed to save post")
+		respondInternalError(w)
 		return
 	}
 
-	title := articleData["title"]
-	content := articleData["content"]
+	post.ID = postID
+
+	queueSummary(postID, userID)
+
+	// suggesting tags needs the embedding, so wait a while for it if there are any tags
+	// to suggest. It's saved either way.
+	embeddings := make(chan []float32, 1)
+	go func() { embeddings <- saveEmbedding(post) }()
+	if hasTags, err := userHasTags(userID); err == nil && hasTags {
+		ctx, cancel := context.WithTimeout(r.Context(), tagSuggestionTimeout)
+		defer cancel()
+		select {
+		case embedding := <-embeddings:
+			if embedding != nil {
+				post.SuggestedTags, _ = suggestTags(postID, userID, embedding)
+			}
+		case <-ctx.Done():
+			logger.Warn("post embedding took too long, responding without tag suggestions", "postID", postID)
+		}
+	}
 
-	totalLength := len(title) + len(url) + len(content)
-	if totalLength > 200000 {
-		logger.Warn("post too long", "url", url, "length", totalLength)
-		respondBadRequest(w)
+	err = postListTemplate.ExecuteTemplate(w, "postEntry", map[string]any{"Post": post, "Index": 0, "Total": 0})
+	if err != nil {
+		logger = logger.With("postID", postID)
+		logAndRespondInternalError(logger, "failed to execute template", w, err)
 		return
 	}
+}
 
-	post := Post{URL: url, Title: title, Body: content, TimeAdded: time.Now().Unix(), UserID: userID}
-	postID, err := savePost(post)
+// respondWithSavedPost responds to an attempt to save a post the user already has.
+// The X-Duplicate-Post header tells the page to replace the existing entry.
+func respondWithSavedPost(w http.ResponseWriter, post Post, markUnread bool, logger *slog.Logger) {
+	logger = logger.With("postID", post.ID)
+	logger.Info("post already saved")
+
+	// saving a trashed post again takes it out of the trash, into the inbox
+	if post.IsTrashed() {
+		if err := restorePost(post.ID, post.UserID); err != nil {
+			respondInternalError(w)
+			return
+		}
+	}
+	if (markUnread && post.State != stateInbox) || post.IsTrashed() {
+		if err := setPostState(post.ID, post.UserID, stateInbox); err != nil {
+			respondInternalError(w)
+			return
+		}
+		post.State = stateInbox
+	}
+
+	w.Header().Set("X-Duplicate-Post", strconv.Itoa(post.ID))
+	err := postListTemplate.ExecuteTemplate(w, "postEntry", map[string]any{"Post": post, "Index": 0, "Total": 0})
 	if err != nil {
-		logger.Error("failed to save post")
+		logAndRespondInternalError(logger, "failed to execute template", w, err)
+	}
+}
+
+// addTagHandler tags a post and responds with the tag, which replaces the suggestion
+// or is added to the post's tags.
+func addTagHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	postID, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+	name, err := normalizeTag(r.Form.Get("name"))
+	if err != nil {
+		http.Error(w, "Error: tags must be 1 to 50 characters", http.StatusBadRequest)
+		return
+	}
+
+	userID := getUserIdFromRequest(r)
+	logger := slog.Default().With("func", "addTagHandler", "userID", userID, "postID", postID)
+
+	added, err := addPostTag(postID, userID, name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Post not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
 		respondInternalError(w)
 		return
 	}
 
-	post.ID = postID
+	// htmx doesn't swap on 204, so the tag isn't shown twice
+	if !added {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
-	go saveEmbedding(post)
+	err = postListTemplate.ExecuteTemplate(w, "tag", map[string]any{"PostID": postID, "Name": name, "Removable": r.Form.Has("removable")})
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to execute tag template", w, err)
+	}
+}
 
-	err = postListTemplate.ExecuteTemplate(w, "postEntry", map[string]any{"Post": post, "Index": 0, "Total": 0})
+func removeTagHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	postID, err := strconv.Atoi(r.Form.Get("id"))
 	if err != nil {
-		logger = logger.With("postID", postID)
-		logAndRespondInternalError(logger, "failed to execute template", w, err)
+		respondBadRequest(w)
+		return
+	}
+	name, err := normalizeTag(r.Form.Get("name"))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+
+	err = removePostTag(postID, getUserIdFromRequest(r), name)
+	if err != nil {
+		respondInternalError(w)
 		return
 	}
 }
 
+// deletePostHandler moves a post to the trash, it's deleted for good after trashRetention.
 func deletePostHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	postID, err := strconv.Atoi(r.Form.Get("id"))
 	if err != nil {
 		respondBadRequest(w)
+		return
 	}
 
 	userID := getUserIdFromRequest(r)
 
-	err = deletePost(userID, postID)
-	if err != nil {
+	err = setPostState(postID, userID, stateTrashed)
+	if errors.Is(err, errStateTransition) {
+		http.Error(w, "Error: can't move post to that state", http.StatusConflict)
+		return
+	} else if err != nil {
 		respondInternalError(w)
 		return
 	}
@@ -304,6 +792,47 @@ func deletePostHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("HX-Redirect", "/saved")
 }
 
+// restorePostHandler takes a post out of the trash. The response is empty, the page
+// removes the trash entry or notice itself.
+func restorePostHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	postID, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+
+	err = restorePost(postID, getUserIdFromRequest(r))
+	if errors.Is(err, errStateTransition) {
+		http.Error(w, "Error: post isn't in the trash", http.StatusConflict)
+	} else if err != nil {
+		respondInternalError(w)
+	}
+}
+
+func deletePostForeverHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	postID, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+
+	err = deletePost(getUserIdFromRequest(r), postID)
+	if err != nil {
+		respondInternalError(w)
+	}
+}
+
+func emptyTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if err := emptyTrash(getUserIdFromRequest(r)); err != nil {
+		respondInternalError(w)
+		return
+	}
+
+	w.Header().Set("HX-Redirect", "/trash")
+}
+
 func isUrl(str string) bool {
 	u, err := url.Parse(str)
 	return err == nil && u.Scheme != "" && u.Host != ""
@@ -359,12 +888,20 @@ func postStaticHandler(w http.ResponseWriter, r *http.Request) {
 
 	logger := slog.Default().With("func", "postStaticHandler", "userID", userID, "postID", postID)
 
-	writeCacheHeader(30*24*60*60, w) // month
+	// posts can change when refetched, so revalidate instead of caching for a fixed time
+	etag := postETag(post)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		respondNotModified(w)
+		return
+	}
+
 	if r.Header.Get("HX-Request") == "true" {
 		logAndRespondInternalError(logger, "shouldnt ever happen?!?!", w, err)
 		return
 	} else {
-		err = postViewTemplate.ExecuteTemplate(w, "base", map[string]any{"Post": post})
+		err = postViewTemplate.ExecuteTemplate(w, "base", baseTemplateData(r, map[string]any{"Post": post}))
 	}
 	if err != nil {
 		logAndRespondInternalError(logger, "failed to execute post view template", w, err)
@@ -372,6 +909,116 @@ func postStaticHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func postETag(post Post) string {
+	h := sha256.New()
+	io.WriteString(h, post.Title)
+	io.WriteString(h, post.URL)
+	io.WriteString(h, string(post.BodyHTML))
+	fmt.Fprint(h, post.PostMetadata)
+	fmt.Fprint(h, post.SummaryStatus, post.Summary)
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+// refetchPostHandler runs extraction again for an existing post, keeping the old
+// version as a revision along with the read and liked state.
+func refetchPostHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	userID := getUserIdFromRequest(r)
+	postID, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+
+	logger := slog.Default().With("func", "refetchPostHandler", "userID", userID, "postID", postID)
+
+	post, err := getPostContent(postID, userID)
+	if err != nil {
+		http.Error(w, "Post not found.", http.StatusNotFound)
+		return
+	}
+
+	article, err := extractArticle(post.URL)
+	if errors.Is(err, errExtractionFailed) || errors.Is(err, errPostTooLong) {
+		logger.Warn("failed to extract article", "url", post.URL, "error", err)
+		respondBadRequest(w)
+		return
+	} else if err != nil {
+		logAndRespondInternalError(logger, "failed to extract article", w, err)
+		return
+	}
+
+	if err := updatePostContent(postID, userID, article.Title, article.Content, article.Metadata()); err != nil {
+		respondInternalError(w)
+		return
+	}
+
+	post.Title = article.Title
+	post.Body = article.Content
+	go saveEmbedding(post)
+	queueSummary(postID, userID)
+
+	w.Header().Set("HX-Redirect", fmt.Sprintf("/post?id=%v", postID))
+}
+
+// postHistoryHandler lists the previous versions of a post and shows the diff
+// between one of them (by default the latest) and the version which replaced it.
+func postHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	userID := getUserIdFromRequest(r)
+	postID, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+
+	logger := slog.Default().With("func", "postHistoryHandler", "userID", userID, "postID", postID)
+
+	post, err := getPostContent(postID, userID)
+	if err != nil {
+		http.Error(w, "Post not found.", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := getPostRevisions(postID, userID)
+	if err != nil {
+		respondInternalError(w)
+		return
+	}
+
+	data := baseTemplateData(r, map[string]any{"Post": post, "Revisions": revisions})
+
+	if len(revisions) > 0 {
+		revisionID := revisions[0].ID
+		if r.Form.Has("rev") {
+			revisionID, err = strconv.Atoi(r.Form.Get("rev"))
+			if err != nil {
+				respondBadRequest(w)
+				return
+			}
+		}
+
+		old, next, err := getPostRevisionPair(revisionID, postID, userID)
+		if err != nil {
+			http.Error(w, "Revision not found.", http.StatusNotFound)
+			return
+		}
+
+		data["Revision"] = old
+		data["Diff"] = diffText(
+			"# "+old.Title+"\n"+htmlToMarkdown(old.Body),
+			"# "+next.Title+"\n"+htmlToMarkdown(next.Body))
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	err = postHistoryTemplate.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to execute post history template", w, err)
+	}
+}
+
 func postStatusHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
@@ -389,6 +1036,12 @@ func postStatusHandler(w http.ResponseWriter, r *http.Request) {
 
 	logger := slog.Default().With("func", "postStatusHandler", "userID", userID, "postID", postID)
 
+	post.Tags, err = getPostTags(postID, userID)
+	if err != nil {
+		respondInternalError(w)
+		return
+	}
+
 	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
 	if r.Header.Get("HX-Request") == "true" {
 		err = postViewTemplate.ExecuteTemplate(w, "postStatus", map[string]any{"Post": post})
@@ -401,6 +1054,31 @@ func postStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func relatedPostsHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	userID := getUserIdFromRequest(r)
+	postID, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+
+	logger := slog.Default().With("func", "relatedPostsHandler", "userID", userID, "postID", postID)
+
+	posts, err := getRelatedPosts(postID, userID)
+	if err != nil {
+		respondInternalError(w)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	err = postViewTemplate.ExecuteTemplate(w, "relatedPosts", map[string]any{"Posts": posts})
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to execute related posts template", w, err)
+	}
+}
+
 func signinPageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
 	w.Header().Set("Vary", "HX-Request")
@@ -409,7 +1087,7 @@ func signinPageHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("HX-Request") == "true" {
 		err = signinTemplate.ExecuteTemplate(w, "signInForm", nil)
 	} else {
-		err = signinTemplate.ExecuteTemplate(w, "base", map[string]any{"isSignIn": true})
+		err = signinTemplate.ExecuteTemplate(w, "base", baseTemplateData(r, map[string]any{"isSignIn": true}))
 	}
 
 	if err != nil {
@@ -426,7 +1104,7 @@ func registerPageHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("HX-Request") == "true" {
 		err = signinTemplate.ExecuteTemplate(w, "registerForm", nil)
 	} else {
-		err = signinTemplate.ExecuteTemplate(w, "base", map[string]any{"isSignIn": false})
+		err = signinTemplate.ExecuteTemplate(w, "base", baseTemplateData(r, map[string]any{"isSignIn": false}))
 	}
 
 	if err != nil {
@@ -540,10 +1218,191 @@ func logRequest(next http.Handler) http.Handler {
 	})
 }
 
+const maxImportFileSize = 32 << 20
+
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIdFromRequest(r)
+	logger := slog.Default().With("func", "importHandler", "userID", userID)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportFileSize)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Error: No file uploaded, or the file is too large.", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to read uploaded file", w, err)
+		return
+	}
+
+	items, format, err := parseImportFile(data)
+	if err != nil {
+		logger.Warn("failed to parse import file", "error", err, "format", format)
+		http.Error(w, "Error: Couldn't read any links from that file.", http.StatusBadRequest)
+		return
+	}
+
+	importID, err := createImport(userID, format, items)
+	if err != nil {
+		http.Error(w, "Error: Failed to start import.", http.StatusInternalServerError)
+		return
+	}
+	wakeImportWorker()
+
+	w.Header().Set("HX-Redirect", fmt.Sprintf("/import?id=%v", importID))
+}
+
+func importPageHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	userID := getUserIdFromRequest(r)
+	logger := slog.Default().With("func", "importPageHandler", "userID", userID)
+
+	data := baseTemplateData(r, nil)
+	if r.Form.Has("id") {
+		importID, err := strconv.Atoi(r.Form.Get("id"))
+		if err != nil {
+			respondBadRequest(w)
+			return
+		}
+		imp, err := getImport(importID, userID)
+		if err != nil {
+			http.Error(w, "Import not found.", http.StatusNotFound)
+			return
+		}
+		data["Import"] = imp
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	err := importTemplate.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to execute import page template", w, err)
+	}
+}
+
+func importStatusHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	userID := getUserIdFromRequest(r)
+
+	importID, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+	imp, err := getImport(importID, userID)
+	if err != nil {
+		http.Error(w, "Import not found.", http.StatusNotFound)
+		return
+	}
+
+	logger := slog.Default().With("func", "importStatusHandler", "userID", userID, "importID", importID)
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	err = importTemplate.ExecuteTemplate(w, "importStatus", map[string]any{"Import": imp})
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to execute import status template", w, err)
+	}
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIdFromRequest(r)
+	logger := slog.Default().With("func", "exportHandler", "userID", userID)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, exportFileName()))
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+
+	// the zip is streamed, so once it's started all we can do on error is log and cut it off
+	if err := writeExport(w, userID); err != nil {
+		logError(logger, "failed to write export", err)
+	}
+}
+
+func accountPageHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIdFromRequest(r)
+	logger := slog.Default().With("func", "accountPageHandler", "userID", userID)
+
+	email, err := getUserEmail(userID)
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to get user email", w, err)
+		return
+	}
+	summariesEnabled, err := getSummariesEnabled(userID)
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to get summary setting", w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
+	err = accountTemplate.ExecuteTemplate(w, "base", baseTemplateData(r, map[string]any{"Email": email, "SummariesEnabled": summariesEnabled}))
+	if err != nil {
+		logAndRespondInternalError(logger, "failed to execute account page template", w, err)
+	}
+}
+
+// summarySettingsHandler turns summaries of newly saved posts on or off.
+func summarySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	err := setSummariesEnabled(getUserIdFromRequest(r), r.Form.Get("enabled") == "true")
+	if err != nil {
+		respondInternalError(w)
+		return
+	}
+
+	w.Header().Set("HX-Redirect", "/account")
+}
+
+// deleteAccountHandler permanently deletes the user and all their data. The user has
+// to enter their password again and type their email to confirm.
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	userID := getUserIdFromRequest(r)
+	logger := slog.Default().With("func", "deleteAccountHandler", "userID", userID)
+
+	email, err := getUserEmail(userID)
+	if err != nil {
+		http.Error(w, "Error: Failed to delete account.", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Form.Get("confirm") != email {
+		http.Error(w, "Error: Type your email to confirm.", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, _, err := getHashedPasswordAndUserId(email)
+	if err != nil {
+		http.Error(w, "Error: Failed to delete account.", http.StatusInternalServerError)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(r.Form.Get("password"))); err != nil {
+		http.Error(w, "Error: Incorrect password.", http.StatusUnauthorized)
+		return
+	}
+
+	if err := deleteUser(userID); err != nil {
+		http.Error(w, "Error: Failed to delete account.", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("deleted account")
+
+	clearAuthToken(w)
+	w.Header().Set("HX-Redirect", "/signin")
+}
+
 func privacyPolicyHandler(w http.ResponseWriter, r *http.Request) {
-	writeCacheHeader(maxCacheTimeout, w)
+	// not cached, the page has this request's csrf token and csp nonce
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0")
 
-	err := privacyPolicyTemplate.ExecuteTemplate(w, "base", nil)
+	err := privacyPolicyTemplate.ExecuteTemplate(w, "base", baseTemplateData(r, nil))
 
 	if err != nil {
 		logger := slog.Default().With("func", "privacyPolicyHandler")
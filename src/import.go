@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Imports let users bring in their library from other read-it-later services. The
+// export file is parsed into import items up front, and a background worker then
+// runs extraction for each item one at a time, so a big import doesn't hammer the
+// node server or the sites being fetched.
+
+const maxImportItems = 50000
+
+var errUnknownImportFormat = errors.New("unrecognized import file format")
+
+type ImportItem struct {
+	ID        int
+	ImportID  int
+	UserID    int
+	URL       string
+	Title     string
+	TimeAdded int64
+	IsRead    bool
+	IsLiked   bool
+	// when the item was archived and liked in the other service, 0 if not known
+	TimeArchived int64
+	TimeLiked    int64
+	Status       string
+	Error        string
+	// how many times processing the item failed in a way worth retrying
+	Attempts int
+}
+
+type Import struct {
+	ID        int
+	UserID    int
+	Format    string
+	CreatedAt int64
+	Total     int
+	Pending   int
+	Done      int
+	Failed    int
+
+	FailedItems []ImportItem
+}
+
+func (imp Import) Finished() bool {
+	return imp.Pending == 0
+}
+
+func (imp Import) Percent() int {
+	if imp.Total == 0 {
+		return 100
+	}
+	return (imp.Done + imp.Failed) * 100 / imp.Total
+}
+
+// parseImportFile detects the format of an export file and parses it. Supported are
+// Pocket HTML/CSV, Instapaper CSV, Omnivore/Readwise JSON and Netscape bookmark
+// HTML (which is also what browsers export).
+func parseImportFile(data []byte) ([]ImportItem, string, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, "", errUnknownImportFormat
+	}
+
+	var items []ImportItem
+	var format string
+	var err error
+	switch {
+	case trimmed[0] == '[' || trimmed[0] == '{':
+		format = "json"
+		items, err = parseJSONExport(trimmed)
+	case trimmed[0] == '<':
+		format = "html"
+		items, err = parseHTMLExport(trimmed)
+	default:
+		format = "csv"
+		items, err = parseCSVExport(trimmed)
+	}
+	if err != nil {
+		return nil, format, err
+	}
+
+	valid := make([]ImportItem, 0, len(items))
+	for _, item := range items {
+		item.URL = strings.TrimSpace(item.URL)
+		if !isUrl(item.URL) {
+			continue
+		}
+		if item.TimeAdded == 0 {
+			item.TimeAdded = time.Now().Unix()
+		}
+		valid = append(valid, item)
+	}
+
+	if len(valid) == 0 {
+		return nil, format, fmt.Errorf("no links found in %v file", format)
+	}
+	if len(valid) > maxImportItems {
+		return nil, format, fmt.Errorf("too many links in file, max is %v", maxImportItems)
+	}
+
+	return valid, format, nil
+}
+
+// parseHTMLExport handles both the Pocket html export, where links are split into
+// "Unread" and "Read Archive" sections, and Netscape bookmark files.
+func parseHTMLExport(data []byte) ([]ImportItem, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []ImportItem
+	inArchive := false
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "h1":
+				inArchive = strings.Contains(strings.ToLower(nodeText(n)), "archive")
+			case "a":
+				item := ImportItem{Title: strings.TrimSpace(nodeText(n)), IsRead: inArchive}
+				for _, a := range n.Attr {
+					switch a.Key {
+					case "href":
+						item.URL = a.Val
+					case "time_added", "add_date":
+						item.TimeAdded = parseTimestamp(a.Val)
+					}
+				}
+				items = append(items, item)
+				return
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return items, nil
+}
+
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+// parseCSVExport maps columns by header name, which covers the Pocket
+// (title,url,time_added,tags,status) and Instapaper (URL,Title,Selection,Folder,Timestamp)
+// exports as well as the Readwise Reader csv.
+func parseCSVExport(data []byte) ([]ImportItem, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	column := func(names ...string) int {
+		for _, name := range names {
+			if i, ok := columns[name]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	urlCol := column("url", "source_url", "original_url")
+	titleCol := column("title")
+	timeCol := column("time_added", "timestamp", "saved_at", "saved date", "created_at")
+	stateCol := column("status", "folder", "location", "state")
+	favoriteCol := column("favorite", "is_favorite", "starred")
+
+	if urlCol == -1 {
+		return nil, fmt.Errorf("csv file has no url column")
+	}
+
+	get := func(record []string, col int) string {
+		if col == -1 || col >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[col])
+	}
+
+	var items []ImportItem
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read csv row: %w", err)
+		}
+
+		state := strings.ToLower(get(record, stateCol))
+		items = append(items, ImportItem{
+			URL:       get(record, urlCol),
+			Title:     get(record, titleCol),
+			TimeAdded: parseTimestamp(get(record, timeCol)),
+			IsRead:    isArchivedState(state),
+			IsLiked:   state == "starred" || isTruthy(get(record, favoriteCol)),
+		})
+	}
+
+	return items, nil
+}
+
+// parseJSONExport handles the Omnivore export (a list of objects with savedAt, state,
+// isArchived...) and Readwise Reader exports (saved_at, location...). A top level
+// object wrapping the list is accepted too.
+func parseJSONExport(data []byte) ([]ImportItem, error) {
+	var entries []map[string]any
+	if data[0] == '{' {
+		var wrapper map[string]json.RawMessage
+		if err := json.Unmarshal(data, &wrapper); err != nil {
+			return nil, err
+		}
+		for _, key := range []string{"results", "items", "articles", "documents", "bookmarks"} {
+			if raw, ok := wrapper[key]; ok {
+				if err := json.Unmarshal(raw, &entries); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	} else if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	str := func(entry map[string]any, keys ...string) string {
+		for _, key := range keys {
+			switch v := entry[key].(type) {
+			case string:
+				return v
+			case float64:
+				return strconv.FormatInt(int64(v), 10)
+			}
+		}
+		return ""
+	}
+	boolean := func(entry map[string]any, keys ...string) bool {
+		for _, key := range keys {
+			if v, ok := entry[key].(bool); ok && v {
+				return true
+			}
+		}
+		return false
+	}
+
+	items := make([]ImportItem, 0, len(entries))
+	for _, entry := range entries {
+		state := strings.ToLower(str(entry, "state", "location", "status"))
+		items = append(items, ImportItem{
+			URL:          str(entry, "url", "originalUrl", "original_url", "source_url"),
+			Title:        str(entry, "title"),
+			TimeAdded:    parseTimestamp(str(entry, "savedAt", "saved_at", "createdAt", "created_at", "time_added")),
+			IsRead:       isArchivedState(state) || boolean(entry, "isArchived", "archived", "is_archived"),
+			IsLiked:      boolean(entry, "isFavorite", "favorite", "is_favorite", "starred", "is_liked"),
+			TimeArchived: parseTimestamp(str(entry, "archivedAt", "archived_at", "time_archived", "readAt", "read_at")),
+			TimeLiked:    parseTimestamp(str(entry, "likedAt", "liked_at", "time_liked", "favoritedAt", "starred_at")),
+		})
+	}
+
+	return items, nil
+}
+
+func isArchivedState(state string) bool {
+	switch state {
+	case "archive", "archived", "read":
+		return true
+	}
+	return false
+}
+
+func isTruthy(s string) bool {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes", "y":
+		return true
+	}
+	return false
+}
+
+// parseTimestamp accepts unix timestamps (in seconds, milli- or microseconds) and
+// the usual date formats, returning unix seconds or 0 if it can't parse the value.
+func parseTimestamp(s string) int64 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch {
+		case n > 1e15:
+			return n / 1e6
+		case n > 1e12:
+			return n / 1e3
+		default:
+			return n
+		}
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, time.RFC3339, "2006-01-02T15:04:05Z0700",
+		"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02", time.RFC1123Z, time.RFC1123} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix()
+		}
+	}
+
+	return 0
+}
+
+// importWakeup is signalled whenever new import items are queued, so the worker
+// doesn't have to wait for its next poll.
+var importWakeup = make(chan struct{}, 1)
+
+const importPollInterval = 30 * time.Second
+
+// items are retried this long after the first failure worth retrying, twice as long
+// after each next one, and fail for good after maxImportAttempts
+const (
+	importRetryDelay  = time.Minute
+	maxImportAttempts = 5
+)
+
+func wakeImportWorker() {
+	select {
+	case importWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// runImportWorker processes queued import items forever. Items queued by the cli
+// are picked up on the next poll.
+func runImportWorker() {
+	if err := resetProcessingImportItems(); err != nil {
+		slog.Error("failed to reset interrupted import items", "error", err)
+	}
+
+	for {
+		item, ok, err := claimPendingImportItem()
+		if err != nil {
+			slog.Error("failed to claim import item", "error", err)
+		}
+		if !ok || err != nil {
+			select {
+			case <-importWakeup:
+			case <-time.After(importPollInterval):
+			}
+			continue
+		}
+
+		processImportItem(item)
+	}
+}
+
+func processImportItem(item ImportItem) {
+	logger := slog.Default().With("func", "processImportItem", "itemID", item.ID, "importID", item.ImportID, "url", item.URL)
+
+	// skip articles the user already has, e.g. from importing the same file twice
+	existing, ok, err := findSavedPost(item.UserID, canonicalizeURL(item.URL))
+	if err != nil {
+		finishImportItem(item.ID, 0, "failed to check for duplicates")
+		return
+	} else if ok {
+		finishImportItem(item.ID, existing.ID, "")
+		return
+	}
+
+	article, err := extractArticle(item.URL)
+	if err != nil && !errors.Is(err, errExtractionFailed) && !errors.Is(err, errPostTooLong) && item.Attempts+1 < maxImportAttempts {
+		// we couldn't talk to the node server, which may just not be up yet
+		delay := importRetryDelay << item.Attempts
+		logger.Warn("failed to extract imported article, retrying later", "error", err, "delay", delay)
+		retryImportItem(item.ID, delay)
+		return
+	} else if err != nil {
+		logger.Warn("failed to extract imported article", "error", err)
+		finishImportItem(item.ID, 0, err.Error())
+		return
+	}
+
+	title := article.Title
+	if title == "" {
+		title = item.Title
+	}
+
+	postURL := canonicalizeURL(item.URL)
+	post := Post{URL: postURL, CanonicalURL: canonicalURLForArticle(postURL, article), Title: title, Body: article.Content,
+		IsLiked: item.IsLiked, TimeAdded: item.TimeAdded, TimeArchived: item.TimeArchived, TimeLiked: item.TimeLiked,
+		UserID: item.UserID, PostMetadata: article.Metadata()}
+	if item.IsRead {
+		post.State = stateArchived
+	}
+	postID, err := savePost(post)
+	if errors.Is(err, errDuplicatePost) {
+		existing, ok, err := findSavedPost(item.UserID, post.CanonicalURL)
+		if err != nil || !ok {
+			finishImportItem(item.ID, 0, "failed to save post")
+			return
+		}
+		finishImportItem(item.ID, existing.ID, "")
+		return
+	} else if err != nil {
+		finishImportItem(item.ID, 0, "failed to save post")
+		return
+	}
+	post.ID = postID
+
+	finishImportItem(item.ID, postID, "")
+
+	queueSummary(postID, item.UserID)
+	saveEmbedding(post)
+}
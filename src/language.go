@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// Posts are full text indexed with the text search configuration of their language,
+// so that words are stemmed the right way. The language is detected when a post is
+// saved, from how many of the most common words of each language its text has.
+
+// textSearchConfigs maps the languages we detect to their postgres text search
+// configuration. Postgres has no Polish stemmer, so Polish isn't stemmed. This has to
+// agree with language_ts_config in migration 018.
+var textSearchConfigs = map[string]string{
+	"en": "english",
+	"de": "german",
+	"fr": "french",
+	"es": "spanish",
+	"it": "italian",
+	"pt": "portuguese",
+	"nl": "dutch",
+	"sv": "swedish",
+	"da": "danish",
+	"fi": "finnish",
+	"ru": "russian",
+	"pl": "simple",
+}
+
+var languageStopWords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "was", "with", "as", "on", "are", "this", "be", "by", "not", "have", "but", "from", "they", "which", "you"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "sich", "des", "auf", "für", "im", "dem", "auch", "es", "wird", "sind", "von"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "que", "pour", "dans", "pas", "qui", "sur", "au", "du", "avec", "ce", "il", "sont", "mais", "nous"},
+	"es": {"el", "la", "los", "las", "y", "que", "del", "en", "es", "por", "con", "una", "para", "no", "se", "su", "al", "lo", "como", "pero", "más"},
+	"it": {"il", "di", "che", "la", "e", "le", "per", "un", "una", "non", "sono", "della", "con", "del", "gli", "anche", "si", "ma", "come", "nel"},
+	"pt": {"o", "a", "os", "as", "que", "de", "do", "da", "em", "um", "uma", "para", "com", "não", "é", "se", "mas", "mais", "por", "no", "na", "dos"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "te", "zijn", "voor", "met", "die", "er", "maar", "ook", "als", "aan", "bij"},
+	"sv": {"och", "att", "det", "som", "en", "är", "på", "av", "för", "med", "inte", "den", "till", "har", "de", "om", "var", "men", "ett", "jag"},
+	"da": {"og", "at", "det", "som", "en", "er", "på", "af", "for", "med", "ikke", "den", "til", "har", "de", "om", "var", "men", "et", "jeg"},
+	"fi": {"ja", "on", "ei", "se", "että", "oli", "hän", "kun", "mutta", "tai", "myös", "ovat", "niin", "kuin", "joka", "ole", "vain", "sen"},
+	"pl": {"i", "w", "nie", "na", "się", "z", "że", "do", "to", "jest", "jak", "o", "ale", "co", "od", "po", "tak", "przez", "dla", "są"},
+	"ru": {"и", "в", "не", "на", "что", "с", "по", "как", "это", "он", "к", "из", "но", "за", "от", "для", "то", "же", "так", "все"},
+}
+
+// stopWordLanguages maps each stop word to the languages it's common in.
+var stopWordLanguages = func() map[string][]string {
+	m := map[string][]string{}
+	for language, words := range languageStopWords {
+		for _, word := range words {
+			m[word] = append(m[word], language)
+		}
+	}
+	return m
+}()
+
+const (
+	// only this many words from the start of the text are looked at
+	languageSampleWords = 2000
+	// texts with fewer words than this don't say enough about their language
+	minLanguageWords = 20
+	// at least this share of the words have to be stop words of the language
+	minStopWordShare = 0.1
+)
+
+// detectLanguage returns the ISO 639-1 code of the language of a post with the given
+// title and html body, "" if it's none of the languages we know.
+func detectLanguage(title, body string) string {
+	text := title
+	if doc, err := html.Parse(strings.NewReader(body)); err == nil {
+		text += " " + nodeText(doc)
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	words = words[:min(len(words), languageSampleWords)]
+	if len(words) < minLanguageWords {
+		return ""
+	}
+
+	hits := map[string]int{}
+	for _, word := range words {
+		for _, language := range stopWordLanguages[word] {
+			hits[language]++
+		}
+	}
+
+	best, bestHits := "", 0
+	for language, n := range hits {
+		if n > bestHits || (n == bestHits && language < best) {
+			best, bestHits = language, n
+		}
+	}
+	if float64(bestHits) < minStopWordShare*float64(len(words)) {
+		return ""
+	}
+	return best
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// wordsPerMinute is a typical silent reading speed for non-fiction.
+const wordsPerMinute = 238
+
+// countWords counts the words in the text of an html body. Chinese and Japanese
+// don't separate words with spaces, so each of their characters counts as a word,
+// which reads at about the same speed.
+func countWords(body string) int {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			count += countTextWords(n.Data)
+		} else if n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style") {
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return count
+}
+
+func countTextWords(text string) int {
+	count := 0
+	inWord := false
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+			count++
+			inWord = false
+		case unicode.IsSpace(r):
+			inWord = false
+		case !inWord && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			count++
+			inWord = true
+		}
+	}
+	return count
+}
+
+// readingMinutes is the estimated time to read a post, rounded to the nearest minute
+// but at least 1 for anything with text in it.
+func readingMinutes(words int) int {
+	if words == 0 {
+		return 0
+	}
+	return max(1, (words+wordsPerMinute/2)/wordsPerMinute)
+}
+
+// LengthFilter limits a post list to posts taking between MinMinutes and MaxMinutes
+// to read, where 0 means no limit.
+type LengthFilter struct {
+	Key        string
+	Label      string
+	MinMinutes int
+	MaxMinutes int
+}
+
+var lengthFilters = []LengthFilter{
+	{Key: "", Label: "Any length"},
+	{Key: "under-5", Label: "Under 5 minutes", MaxMinutes: 5},
+	{Key: "under-10", Label: "Under 10 minutes", MaxMinutes: 10},
+	{Key: "under-15", Label: "Under 15 minutes", MaxMinutes: 15},
+	{Key: "10-30", Label: "10 to 30 minutes", MinMinutes: 10, MaxMinutes: 30},
+	{Key: "over-30", Label: "Over 30 minutes", MinMinutes: 30},
+}
+
+func getLengthFilter(key string) LengthFilter {
+	for _, filter := range lengthFilters {
+		if filter.Key == key {
+			return filter
+		}
+	}
+	return lengthFilters[0]
+}
+
+// sql returns a condition on word_count for the filter, or "" if it doesn't filter.
+// The bounds are in words so the posts match what readingMinutes shows.
+func (f LengthFilter) sql() string {
+	var conds []string
+	if f.MinMinutes > 0 {
+		conds = append(conds, fmt.Sprintf("word_count >= %d", f.MinMinutes*wordsPerMinute-wordsPerMinute/2))
+	}
+	if f.MaxMinutes > 0 {
+		conds = append(conds, fmt.Sprintf("word_count < %d", f.MaxMinutes*wordsPerMinute-wordsPerMinute/2))
+	}
+	return strings.Join(conds, " AND ")
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/pgvector/pgvector-go"
@@ -26,6 +27,9 @@ var postListTemplate *template.Template
 var postViewTemplate *template.Template
 var signinTemplate *template.Template
 var privacyPolicyTemplate *template.Template
+var importTemplate *template.Template
+var accountTemplate *template.Template
+var postHistoryTemplate *template.Template
 
 // Initialize and parse templates once at startup
 func initTemplates() {
@@ -61,26 +65,48 @@ func initTemplates() {
 		return host, nil
 	}
 
+	formatTime := func(unix int64) string {
+		return time.Unix(unix, 0).UTC().Format("2 Jan 2006 15:04")
+	}
+
+	formatDate := func(unix int64) string {
+		return time.Unix(unix, 0).UTC().Format("2 Jan 2006")
+	}
+
 	postListTemplate = template.Must(template.New("").
-		Funcs(template.FuncMap{"dict": dict, "isLast": isLast, "baseURL": getBaseURL}).
+		Funcs(template.FuncMap{"dict": dict, "isLast": isLast, "baseURL": getBaseURL, "formatDate": formatDate}).
 		ParseFiles("templates/posts/postBase.html", "templates/posts/postList.html", "templates/base.html"))
 
+	postViewTemplate = template.Must(template.New("").
+		Funcs(template.FuncMap{"dict": dict, "baseURL": getBaseURL, "formatDate": formatDate}).
+		ParseFiles("templates/posts/postBase.html", "templates/posts/postView.html", "templates/base.html"))
+
 	var err error
-	postViewTemplate, err = template.ParseFiles("templates/posts/postBase.html", "templates/posts/postView.html", "templates/base.html")
+
+	signinTemplate, err = template.ParseFiles("templates/signin.html", "templates/base.html")
 	if err != nil {
 		panic(err)
 	}
 
-	signinTemplate, err = template.ParseFiles("templates/signin.html", "templates/base.html")
+	privacyPolicyTemplate, err = template.ParseFiles("templates/privacyPolicy.html", "templates/base.html")
 	if err != nil {
 		panic(err)
 	}
 
-	privacyPolicyTemplate, err = template.ParseFiles("templates/privacyPolicy.html", "templates/base.html")
+	importTemplate, err = template.ParseFiles("templates/posts/postBase.html", "templates/import.html", "templates/base.html")
+	if err != nil {
+		panic(err)
+	}
+
+	accountTemplate, err = template.ParseFiles("templates/posts/postBase.html", "templates/account.html", "templates/base.html")
 	if err != nil {
 		panic(err)
 	}
 
+	postHistoryTemplate = template.Must(template.New("").
+		Funcs(template.FuncMap{"formatTime": formatTime}).
+		ParseFiles("templates/posts/postBase.html", "templates/posts/postHistory.html", "templates/base.html"))
+
 }
 
 func initDatabase() {
@@ -98,23 +124,14 @@ func initDatabase() {
 }
 
 func main() {
-	initDatabase()
-	initTemplates()
-	initOpenaiClient()
-	addHandleFuncs()
-
-	// init the node server
-	cmd := exec.Command("node", "../postSimplifyingServer.js")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err := cmd.Process.Kill(); err != nil {
-			log.Printf("Failed to kill Node.js server: %v", err)
+	// subcommands like `lucentsave import` are run instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-	}()
+		return
+	}
 
 	// set up logging
 	if os.Getenv("ENV") == "production" {
@@ -145,6 +162,47 @@ func main() {
 		slog.SetDefault(logger)
 	}
 
-	loggedMux := logRequest(http.DefaultServeMux)
+	initDatabase()
+	initTemplates()
+	initOpenaiClient()
+	initEmbeddingSpaces()
+	// the vocabularies are downloaded now rather than when the first post is embedded
+	tokenizerForModel(activeEmbedding.Model)
+	if nextEmbedding != nil {
+		tokenizerForModel(nextEmbedding.Model)
+	}
+	initSummarizer()
+	initChatProvider()
+	addHandleFuncs()
+
+	// init the node server
+	cmd := exec.Command("node", "../postSimplifyingServer.js")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := cmd.Process.Kill(); err != nil {
+			log.Printf("Failed to kill Node.js server: %v", err)
+		}
+	}()
+	// the import worker extracts articles as soon as it starts
+	if err := waitForNodeServer(nodeServerStartTimeout); err != nil {
+		slog.Error("node server didn't start", "error", err)
+	}
+
+	go runImportWorker()
+	go runTrashPurger()
+	go runTopicClusterer()
+	go runSummaryWorker()
+	if persistQueryCache {
+		go runQueryCachePruner()
+	}
+	if nextEmbedding != nil {
+		go runReembedder()
+	}
+
+	loggedMux := logRequest(securityHeadersMiddleware(csrfMiddleware(http.DefaultServeMux)))
 	log.Fatal(http.ListenAndServe(":8080", loggedMux))
 }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlToMarkdown converts a (sanitized) post body to markdown. It handles the
+// elements readability leaves in articles; anything else is reduced to its text.
+func htmlToMarkdown(body string) string {
+	parent := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(body), parent)
+	if err != nil {
+		return body
+	}
+
+	c := &markdownConverter{}
+	for _, n := range nodes {
+		c.convert(n)
+	}
+
+	return strings.TrimSpace(collapseBlankLines(c.sb.String())) + "\n"
+}
+
+// collapseBlankLines trims trailing whitespace and merges runs of blank lines, where
+// a line which is only blockquote markers also counts as blank.
+func collapseBlankLines(s string) string {
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	prevBlank := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		blank := strings.Trim(line, "> ") == ""
+		if blank && prevBlank {
+			// keep whichever blank line is least deeply quoted
+			if strings.Count(line, ">") < strings.Count(out[len(out)-1], ">") {
+				out[len(out)-1] = line
+			}
+			continue
+		}
+		out = append(out, line)
+		prevBlank = blank
+	}
+	return strings.Join(out, "\n")
+}
+
+var collapseWhitespace = regexp.MustCompile(`\s+`)
+
+type markdownConverter struct {
+	sb strings.Builder
+
+	// prefix written after every newline, for blockquotes and list item continuations
+	prefix string
+	// stack of list counters, -1 for unordered lists
+	lists []int
+	inPre bool
+	// set right after a list marker or quote is opened, where a block break would
+	// leave the marker on a line of its own
+	opened bool
+}
+
+func (c *markdownConverter) write(s string) {
+	if s == "" {
+		return
+	}
+	if c.prefix != "" {
+		s = strings.ReplaceAll(s, "\n", "\n"+c.prefix)
+	}
+	c.sb.WriteString(s)
+	c.opened = false
+}
+
+func (c *markdownConverter) block() {
+	if !c.opened {
+		c.write("\n\n")
+	}
+}
+
+func (c *markdownConverter) children(n *html.Node) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.convert(child)
+	}
+}
+
+func (c *markdownConverter) convert(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		if c.inPre {
+			c.write(n.Data)
+		} else {
+			c.write(escapeMarkdown(collapseWhitespace.ReplaceAllString(n.Data, " ")))
+		}
+		return
+	case html.ElementNode:
+	default:
+		c.children(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		c.block()
+		c.write(strings.Repeat("#", level) + " " + strings.TrimSpace(inlineMarkdown(n)))
+		c.block()
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Aside,
+		atom.Figure, atom.Figcaption, atom.Table, atom.Details, atom.Summary, atom.Dl:
+		c.block()
+		if n.DataAtom == atom.Table {
+			c.table(n)
+		} else {
+			c.children(n)
+		}
+		c.block()
+	case atom.Br:
+		c.write("\\\n")
+	case atom.Hr:
+		c.block()
+		c.write("---")
+		c.block()
+	case atom.Strong, atom.B:
+		c.wrap(n, "**")
+	case atom.Em, atom.I, atom.Cite:
+		c.wrap(n, "_")
+	case atom.Del, atom.S:
+		c.wrap(n, "~~")
+	case atom.Code, atom.Kbd, atom.Samp:
+		if c.inPre {
+			c.children(n)
+		} else {
+			text := nodeText(n)
+			fence := "`"
+			if strings.Contains(text, "`") {
+				fence = "``"
+			}
+			c.write(fence + text + fence)
+		}
+	case atom.Pre:
+		c.block()
+		c.write("```\n")
+		c.inPre = true
+		c.children(n)
+		c.inPre = false
+		c.write("\n```")
+		c.block()
+	case atom.A:
+		href := getAttr(n, "href")
+		text := strings.TrimSpace(inlineMarkdown(n))
+		if href == "" || strings.HasPrefix(href, "#") {
+			c.write(text)
+		} else {
+			c.write("[" + text + "](" + href + ")")
+		}
+	case atom.Img:
+		if src := getAttr(n, "src"); src != "" && !strings.HasPrefix(src, "data:") {
+			c.write("![" + escapeMarkdown(getAttr(n, "alt")) + "](" + src + ")")
+		}
+	case atom.Blockquote:
+		c.block()
+		prev := c.prefix
+		c.prefix += "> "
+		c.write("> ")
+		c.opened = true
+		c.children(n)
+		c.prefix = prev
+		c.block()
+	case atom.Ul, atom.Ol:
+		counter := -1
+		if n.DataAtom == atom.Ol {
+			counter = 1
+		}
+		c.lists = append(c.lists, counter)
+		if len(c.lists) == 1 {
+			c.block()
+		}
+		c.children(n)
+		c.lists = c.lists[:len(c.lists)-1]
+		if len(c.lists) == 0 {
+			c.block()
+		}
+	case atom.Li:
+		marker := "- "
+		if len(c.lists) > 0 && c.lists[len(c.lists)-1] > 0 {
+			marker = fmt.Sprintf("%d. ", c.lists[len(c.lists)-1])
+			c.lists[len(c.lists)-1]++
+		}
+		c.write("\n" + marker)
+		c.opened = true
+		prev := c.prefix
+		c.prefix += strings.Repeat(" ", len(marker))
+		c.children(n)
+		c.prefix = prev
+	case atom.Dt:
+		c.write("\n**" + strings.TrimSpace(inlineMarkdown(n)) + "**")
+	case atom.Dd:
+		c.write("\n: ")
+		c.children(n)
+	default:
+		c.children(n)
+	}
+}
+
+func (c *markdownConverter) wrap(n *html.Node, marker string) {
+	text := inlineMarkdown(n)
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		c.write(text)
+		return
+	}
+	// markdown emphasis can't start or end with whitespace, so move it outside
+	leading := text[:len(text)-len(strings.TrimLeft(text, " "))]
+	trailing := text[len(strings.TrimRight(text, " ")):]
+	c.write(leading + marker + trimmed + marker + trailing)
+}
+
+func (c *markdownConverter) table(n *html.Node) {
+	var rows [][]string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Tr {
+			var row []string
+			for cell := n.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+					row = append(row, strings.ReplaceAll(strings.TrimSpace(inlineMarkdown(cell)), "|", `\|`))
+				}
+			}
+			rows = append(rows, row)
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+
+	if len(rows) == 0 {
+		return
+	}
+
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		c.write("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			c.write(strings.Repeat("| --- ", columns) + "|\n")
+		}
+	}
+}
+
+// inlineMarkdown converts the children of n on their own, for places where the
+// result has to fit on one line.
+func inlineMarkdown(n *html.Node) string {
+	c := &markdownConverter{}
+	c.children(n)
+	return strings.ReplaceAll(c.sb.String(), "\n", " ")
+}
+
+var markdownSpecialChars = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "<", "&lt;", ">", "&gt;",
+)
+
+func escapeMarkdown(s string) string {
+	return markdownSpecialChars.Replace(s)
+}
+
+func getAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The /saved and /read lists are loaded a page at a time with keyset pagination: the
+// cursor for the next page holds the sort key values of the last post shown, and the
+// next page is the posts after it in sort order. Unlike offsets this stays correct
+// when posts are saved or marked read while scrolling, and doesn't get slower the
+// further down the list you go.
+
+const postPageSize = 50
+
+// sortKey is one column of a sort order. Cursor values go through the db as text and
+// are cast back to sqlType for comparison.
+type sortKey struct {
+	expr    string
+	sqlType string
+	desc    bool
+}
+
+// siteSQL is the host of a post's url without www., which is what "by site" groups on.
+const siteSQL = `lower(coalesce(substring(url from '://(?:www\.)?([^/:?#]+)'), url))`
+
+// PostSort is a way of ordering the /saved and /read lists. The last key of every
+// sort is id, so that the order is total and cursors are unambiguous.
+type PostSort struct {
+	Key   string
+	Label string
+	keys  []sortKey
+}
+
+var postSorts = []PostSort{
+	{Key: "", Label: "Newest first", keys: []sortKey{
+		{"time_added", "bigint", true}, {"id", "integer", true}}},
+	{Key: "oldest", Label: "Oldest first", keys: []sortKey{
+		{"time_added", "bigint", false}, {"id", "integer", false}}},
+	{Key: "longest", Label: "Longest first", keys: []sortKey{
+		{"coalesce(word_count, 0)", "integer", true}, {"id", "integer", true}}},
+	{Key: "shortest", Label: "Shortest first", keys: []sortKey{
+		// posts which haven't been counted yet go last
+		{"coalesce(word_count, 2147483647)", "integer", false}, {"id", "integer", false}}},
+	{Key: "site", Label: "By site", keys: []sortKey{
+		{siteSQL, "text", false}, {"time_added", "bigint", true}, {"id", "integer", true}}},
+	// the keys for random depend on the seed, see PostListOptions.sortKeys
+	{Key: "random", Label: "Random"},
+}
+
+func getPostSort(key string) PostSort {
+	for _, sort := range postSorts {
+		if sort.Key == key {
+			return sort
+		}
+	}
+	return postSorts[0]
+}
+
+// PostListOptions are the sorting and filtering chosen for a post list.
+type PostListOptions struct {
+	Sort   PostSort
+	Length LengthFilter
+	// Seed keeps the random order the same from one page to the next
+	Seed int64
+}
+
+func postListOptionsFromQuery(query url.Values) PostListOptions {
+	opts := PostListOptions{
+		Sort:   getPostSort(query.Get("sort")),
+		Length: getLengthFilter(query.Get("length")),
+	}
+
+	if opts.Sort.Key == "random" {
+		seed, err := strconv.ParseInt(query.Get("seed"), 10, 64)
+		if err != nil {
+			seed = rand.Int64()
+		}
+		opts.Seed = seed
+	}
+
+	return opts
+}
+
+func (opts PostListOptions) sortKeys() []sortKey {
+	if opts.Sort.Key == "random" {
+		// hashing the id with the seed shuffles the posts in a way we can page through
+		return []sortKey{{fmt.Sprintf("md5(id::text || '%d')", opts.Seed), "text", false}, {"id", "integer", false}}
+	}
+	return opts.Sort.keys
+}
+
+// query returns the url query for the list with these options, starting at cursor.
+func (opts PostListOptions) query(cursor string) url.Values {
+	values := url.Values{}
+	if opts.Sort.Key != "" {
+		values.Set("sort", opts.Sort.Key)
+	}
+	if opts.Length.Key != "" {
+		values.Set("length", opts.Length.Key)
+	}
+	if opts.Sort.Key == "random" {
+		values.Set("seed", strconv.FormatInt(opts.Seed, 10))
+	}
+	if cursor != "" {
+		values.Set("cursor", cursor)
+	}
+	return values
+}
+
+// orderSQL returns the ORDER BY clause for keys.
+func orderSQL(keys []sortKey) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key.expr
+		if key.desc {
+			parts[i] += " DESC"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// keysetSQL returns a condition selecting the rows after the cursor, whose values are
+// passed as parameters starting at $firstParam. When all keys sort the same way this
+// is a row comparison, which postgres can use an index for. Otherwise it's spelled
+// out as (k0 > v0) OR (k0 = v0 AND k1 > v1) OR ...
+func keysetSQL(keys []sortKey, firstParam int) string {
+	param := func(i int) string {
+		return fmt.Sprintf("$%d::text::%s", firstParam+i, keys[i].sqlType)
+	}
+
+	sameDirection := true
+	for _, key := range keys {
+		sameDirection = sameDirection && key.desc == keys[0].desc
+	}
+	if sameDirection {
+		exprs := make([]string, len(keys))
+		params := make([]string, len(keys))
+		for i, key := range keys {
+			exprs[i] = key.expr
+			params[i] = param(i)
+		}
+		op := " > "
+		if keys[0].desc {
+			op = " < "
+		}
+		return "(" + strings.Join(exprs, ", ") + ")" + op + "(" + strings.Join(params, ", ") + ")"
+	}
+
+	ors := make([]string, len(keys))
+	for i, key := range keys {
+		var ands []string
+		for j := 0; j < i; j++ {
+			ands = append(ands, keys[j].expr+" = "+param(j))
+		}
+		op := " > "
+		if key.desc {
+			op = " < "
+		}
+		ands = append(ands, key.expr+op+param(i))
+		ors[i] = "(" + strings.Join(ands, " AND ") + ")"
+	}
+	return "(" + strings.Join(ors, " OR ") + ")"
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(values []string) string {
+	data, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the sort key values in a cursor, nil for an empty one.
+func decodeCursor(cursor string, keys []sortKey) ([]string, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil || len(values) != len(keys) {
+		return nil, errInvalidCursor
+	}
+
+	// values postgres can't cast to the key's type would fail the whole query
+	for i, value := range values {
+		if !validCursorValue(value, keys[i].sqlType) {
+			return nil, errInvalidCursor
+		}
+	}
+
+	return values, nil
+}
+
+func validCursorValue(value string, sqlType string) bool {
+	switch sqlType {
+	case "bigint":
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	case "integer":
+		_, err := strconv.ParseInt(value, 10, 32)
+		return err == nil
+	case "text":
+		return utf8.ValidString(value) && !strings.ContainsRune(value, 0)
+	}
+	return false
+}
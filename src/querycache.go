@@ -0,0 +1,148 @@
+package main
+
+import (
+	"container/list"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Search queries are embedded on every keystroke, so their embeddings are kept in an
+// LRU cache keyed by user, model and query. With LS2_QUERY_CACHE_DB=true the cache is
+// also persisted in postgres, so it survives restarts and is shared between instances.
+// Users never share entries, so what someone searched for is deleted with their
+// account.
+
+const defaultQueryCacheSize = 1000
+
+// persisted query embeddings which haven't been used for this long are deleted
+const queryCacheRetention = 30 * 24 * time.Hour
+
+type queryCacheKey struct {
+	userID int
+	model  string
+	query  string
+}
+
+type queryCacheEntry struct {
+	key       queryCacheKey
+	embedding []float32
+}
+
+type queryEmbeddingCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // most recently used first
+	entries  map[queryCacheKey]*list.Element
+}
+
+func newQueryEmbeddingCache(capacity int) *queryEmbeddingCache {
+	return &queryEmbeddingCache{capacity: capacity, order: list.New(), entries: map[queryCacheKey]*list.Element{}}
+}
+
+func (c *queryEmbeddingCache) get(key queryCacheKey) ([]float32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*queryCacheEntry).embedding, true
+}
+
+func (c *queryEmbeddingCache) add(key queryCacheKey, embedding []float32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*queryCacheEntry).embedding = embedding
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&queryCacheEntry{key, embedding})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*queryCacheEntry).key)
+	}
+}
+
+var queryCache = newQueryEmbeddingCache(queryCacheSize())
+
+var persistQueryCache = os.Getenv("LS2_QUERY_CACHE_DB") == "true"
+
+func queryCacheSize() int {
+	size, err := strconv.Atoi(os.Getenv("LS2_QUERY_CACHE_SIZE"))
+	if err != nil || size <= 0 {
+		return defaultQueryCacheSize
+	}
+	return size
+}
+
+// normalizeQuery collapses whitespace, which doesn't change what a query means but
+// would otherwise miss the cache.
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// getQueryEmbedding returns the embedding of a search query in the space, from the
+// cache if we have it. Embedding it otherwise counts towards the user's usage.
+func getQueryEmbedding(userID int, space embeddingSpace, query string) ([]float32, error) {
+	if embedding, ok := cachedQueryEmbedding(userID, space, query); ok {
+		return embedding, nil
+	}
+
+	key := queryCacheKey{userID: userID, model: space.String(), query: normalizeQuery(query)}
+	embedding, err := getEmbedding(userID, space, key.query)
+	if err != nil {
+		return nil, err
+	}
+
+	queryCache.add(key, embedding)
+	if persistQueryCache {
+		cacheQueryEmbedding(userID, key.model, key.query, embedding)
+	}
+
+	return embedding, nil
+}
+
+// cachedQueryEmbedding returns the embedding of a search query in the space if it's
+// cached, without ever embedding it.
+func cachedQueryEmbedding(userID int, space embeddingSpace, query string) ([]float32, bool) {
+	key := queryCacheKey{userID: userID, model: space.String(), query: normalizeQuery(query)}
+
+	if embedding, ok := queryCache.get(key); ok {
+		return embedding, true
+	}
+
+	if persistQueryCache {
+		embedding, ok, err := getCachedQueryEmbedding(userID, key.model, key.query)
+		if err == nil && ok {
+			queryCache.add(key, embedding)
+			return embedding, true
+		}
+	}
+
+	return nil, false
+}
+
+// runQueryCachePruner deletes persisted query embeddings which haven't been used in
+// a while, once a day.
+func runQueryCachePruner() {
+	for {
+		deleted, err := pruneQueryEmbeddings(time.Now().Add(-queryCacheRetention).Unix())
+		if err != nil {
+			slog.Error("failed to prune query embedding cache", "error", err)
+		} else if deleted > 0 {
+			slog.Info("pruned query embedding cache", "count", deleted)
+		}
+
+		time.Sleep(24 * time.Hour)
+	}
+}
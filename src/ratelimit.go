@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Embedding requests are batched, held to the provider's rate limits with token
+// buckets for requests and tokens per minute, and retried with backoff if the
+// provider says we went over anyway. The tokens each user's requests use are counted
+// per day, and with LS2_EMBEDDING_DAILY_TOKEN_CAP set users can't go over that.
+
+// OpenAI takes up to 2048 inputs and 300k tokens per embeddings request
+const (
+	maxEmbeddingBatchInputs = 2048
+	maxEmbeddingBatchTokens = 250000
+)
+
+const (
+	defaultEmbeddingRequestsPerMinute = 3000
+	defaultEmbeddingTokensPerMinute   = 1000000
+)
+
+const maxEmbeddingRetries = 4
+
+var errEmbeddingQuotaExceeded = errors.New("daily embedding token limit reached")
+
+// tokenBucket allows perMinute units a minute, in bursts of up to a minute's worth.
+type tokenBucket struct {
+	mu        sync.Mutex
+	capacity  float64
+	tokens    float64
+	perSecond float64
+	last      time.Time
+}
+
+func newTokenBucket(perMinute float64) *tokenBucket {
+	return &tokenBucket{capacity: perMinute, tokens: perMinute, perSecond: perMinute / 60, last: time.Now()}
+}
+
+// take waits until n units are available and takes them. Taking more than the
+// capacity waits for a full bucket.
+func (b *tokenBucket) take(ctx context.Context, n float64) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.perSecond)
+		b.last = now
+
+		n = min(n, b.capacity)
+		if b.tokens >= n {
+			b.tokens -= n
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((n - b.tokens) / b.perSecond * float64(time.Second))
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+var (
+	embeddingRequestLimiter = newTokenBucket(envFloat("LS2_EMBEDDING_RPM", defaultEmbeddingRequestsPerMinute))
+	embeddingTokenLimiter   = newTokenBucket(envFloat("LS2_EMBEDDING_TPM", defaultEmbeddingTokensPerMinute))
+)
+
+// embeddingDailyTokenCap is the most tokens a user's embeddings can use a day, 0 for no limit.
+var embeddingDailyTokenCap = int64(envFloat("LS2_EMBEDDING_DAILY_TOKEN_CAP", 0))
+
+func envFloat(name string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// estimateTokens is a rough upper bound on the tokens in a text, for rate limiting
+// before the provider tells us the real count.
+func estimateTokens(text string) int {
+	return len(text)/3 + 1
+}
+
+// usageDay is the day usage is counted towards, in UTC.
+func usageDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// systemUserID is who embeddings are made for when the system makes them on its own,
+// like when posts are re-embedded with a new model. They aren't capped or counted
+// towards anyone's usage. User ids start at 1.
+const systemUserID = 0
+
+// embedTexts embeds the texts in as few requests as possible, counting the tokens
+// towards the user's usage. It fails with errEmbeddingQuotaExceeded once the user
+// has used up their daily tokens; the request which goes over the cap still runs.
+func embedTexts(userID int, space embeddingSpace, texts []string) ([][]float32, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	if embeddingDailyTokenCap > 0 && userID != systemUserID {
+		used, err := getEmbeddingTokensUsed(userID, usageDay(time.Now()))
+		if err != nil {
+			return nil, err
+		}
+		if used >= embeddingDailyTokenCap {
+			return nil, errEmbeddingQuotaExceeded
+		}
+	}
+
+	ctx := context.Background()
+	embeddings := make([][]float32, len(texts))
+
+	for start := 0; start < len(texts); {
+		end, tokens := start, 0
+		for end < len(texts) && end-start < maxEmbeddingBatchInputs &&
+			(end == start || tokens+estimateTokens(texts[end]) <= maxEmbeddingBatchTokens) {
+			tokens += estimateTokens(texts[end])
+			end++
+		}
+
+		if err := embeddingRequestLimiter.take(ctx, 1); err != nil {
+			return nil, err
+		}
+		if err := embeddingTokenLimiter.take(ctx, float64(tokens)); err != nil {
+			return nil, err
+		}
+
+		resp, err := createEmbeddingsWithRetry(ctx, space, texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		if userID != systemUserID {
+			if err := recordEmbeddingUsage(userID, usageDay(time.Now()), resp.Usage.TotalTokens); err != nil {
+				slog.Error("failed to record embedding usage", "userID", userID, "error", err)
+			}
+		}
+
+		for _, data := range resp.Data {
+			if data.Index < 0 || data.Index >= end-start {
+				return nil, fmt.Errorf("embedding returned for unknown input %v", data.Index)
+			}
+			if len(data.Embedding) != space.Dimensions {
+				return nil, fmt.Errorf("got embedding with %v dimensions from %v", len(data.Embedding), space)
+			}
+			embeddings[start+data.Index] = data.Embedding
+		}
+
+		start = end
+	}
+
+	for _, embedding := range embeddings {
+		if embedding == nil {
+			return nil, fmt.Errorf("no embedding returned")
+		}
+	}
+
+	return embeddings, nil
+}
+
+// createEmbeddingsWithRetry makes an embeddings request, backing off and retrying
+// when rate limited.
+func createEmbeddingsWithRetry(ctx context.Context, space embeddingSpace, inputs []string) (openai.EmbeddingResponse, error) {
+	req := openai.EmbeddingRequest{Model: openai.EmbeddingModel(space.Model), Input: inputs}
+	if space.Dimensions != defaultEmbeddingDimensions[space.Model] {
+		req.Dimensions = space.Dimensions
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		resp, err := client.CreateEmbeddings(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		if !isRateLimitError(err) || attempt == maxEmbeddingRetries {
+			return openai.EmbeddingResponse{}, fmt.Errorf("failed to create embedding: %w", err)
+		}
+
+		slog.Warn("embedding request rate limited, retrying", "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return openai.EmbeddingResponse{}, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func isRateLimitError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Embeddings from different models can't be compared, so changing the model means
+// re-embedding every post. The model and dimensions search uses are stored in
+// embedding_config. When LS2_EMBEDDING_MODEL or LS2_EMBEDDING_DIMENSIONS ask for
+// something else, posts are re-embedded in the background into posts.embedding_next
+// while search goes on using posts.embedding. Once every post has a new embedding, the
+// new column is indexed and swapped in for the old one in a single transaction.
+
+const reembedBatchSize = 20
+
+const reembedInterval = 5 * time.Minute
+
+// pgvector's hnsw index only takes vectors of up to this many dimensions
+const maxIndexedDimensions = 2000
+
+// embeddingSpaceMu is held for reading while post embeddings are stored, after
+// checking they're in a space which is still in use, and for writing while the
+// embeddings are swapped. Embeddings are computed without it, so swapping doesn't
+// wait for the embeddings api.
+var embeddingSpaceMu sync.RWMutex
+
+var (
+	// activeEmbedding is the space the embeddings posts are searched by are in
+	activeEmbedding embeddingSpace
+	// nextEmbedding is the space posts are being re-embedded into, nil if none
+	nextEmbedding *embeddingSpace
+)
+
+func currentEmbeddingSpace() embeddingSpace {
+	embeddingSpaceMu.RLock()
+	defer embeddingSpaceMu.RUnlock()
+	return activeEmbedding
+}
+
+// embeddingSpaces returns the active embedding space and the one being migrated to,
+// nil if none.
+func embeddingSpaces() (active embeddingSpace, next *embeddingSpace) {
+	embeddingSpaceMu.RLock()
+	defer embeddingSpaceMu.RUnlock()
+	if nextEmbedding != nil {
+		next = new(embeddingSpace)
+		*next = *nextEmbedding
+	}
+	return activeEmbedding, next
+}
+
+// configuredEmbeddingSpace returns the space set in the environment, defaulting to
+// the active one.
+func configuredEmbeddingSpace(active embeddingSpace) (embeddingSpace, error) {
+	model := os.Getenv("LS2_EMBEDDING_MODEL")
+	if model == "" {
+		model = active.Model
+	}
+
+	dimensions := defaultEmbeddingDimensions[model]
+	if model == active.Model {
+		dimensions = active.Dimensions
+	}
+	if env := os.Getenv("LS2_EMBEDDING_DIMENSIONS"); env != "" {
+		var err error
+		if dimensions, err = strconv.Atoi(env); err != nil || dimensions <= 0 {
+			return embeddingSpace{}, fmt.Errorf("invalid LS2_EMBEDDING_DIMENSIONS %q", env)
+		}
+	}
+	if dimensions == 0 {
+		return embeddingSpace{}, fmt.Errorf("LS2_EMBEDDING_DIMENSIONS is needed for model %v", model)
+	}
+	if dimensions > maxIndexedDimensions {
+		return embeddingSpace{}, fmt.Errorf("embeddings of %v dimensions can't be indexed, set LS2_EMBEDDING_DIMENSIONS to at most %v",
+			dimensions, maxIndexedDimensions)
+	}
+
+	return embeddingSpace{Model: model, Dimensions: dimensions}, nil
+}
+
+// initEmbeddingSpaces loads the active embedding space, and starts or drops a
+// migration to another one if the configured space changed.
+func initEmbeddingSpaces() {
+	active, next, err := getEmbeddingSpaces()
+	if err != nil {
+		panic(fmt.Errorf("failed to get embedding config: %v", err))
+	}
+
+	configured, err := configuredEmbeddingSpace(active)
+	if err != nil {
+		panic(err)
+	}
+
+	switch {
+	case configured == active && next != nil:
+		slog.Info("dropping unfinished embedding migration", "from", active, "to", *next)
+		if err := abandonEmbeddingMigration(); err != nil {
+			panic(fmt.Errorf("failed to drop embedding migration: %v", err))
+		}
+		next = nil
+	case configured != active && (next == nil || *next != configured):
+		slog.Info("starting embedding migration", "from", active, "to", configured)
+		if err := startEmbeddingMigration(configured); err != nil {
+			panic(fmt.Errorf("failed to start embedding migration: %v", err))
+		}
+		next = &configured
+	}
+
+	activeEmbedding, nextEmbedding = active, next
+}
+
+var errEmbeddingSpaceUnused = errors.New("embedding space no longer in use")
+
+// storePostEmbedding stores a post's embedding as the one search uses or the one
+// being migrated to, whichever is in its space. Embeddings are computed without
+// embeddingSpaceMu, so the spaces may have changed meanwhile, and it fails with
+// errEmbeddingSpaceUnused if neither is in the space any more.
+func storePostEmbedding(postID int, space embeddingSpace, embedding []float32) error {
+	embeddingSpaceMu.RLock()
+	defer embeddingSpaceMu.RUnlock()
+
+	switch {
+	case activeEmbedding == space:
+		return setPostEmbedding(postID, space, embedding)
+	case nextEmbedding != nil && *nextEmbedding == space:
+		return setPostNextEmbedding(postID, space, embedding)
+	default:
+		return errEmbeddingSpaceUnused
+	}
+}
+
+// runReembedder re-embeds posts into the next embedding space until all of them are,
+// then swaps the embeddings and returns.
+func runReembedder() {
+	for {
+		if done := reembedPosts(); done {
+			return
+		}
+		time.Sleep(reembedInterval)
+	}
+}
+
+// reembedPosts makes a pass over the posts which still need re-embedding, and cuts
+// search over to the new embeddings if none are left. Reports whether the migration
+// is over.
+func reembedPosts() bool {
+	logger := slog.Default().With("func", "reembedPosts")
+
+	// another instance may have finished the migration
+	active, next, err := getEmbeddingSpaces()
+	if err != nil {
+		return false
+	}
+	if next == nil || nextEmbedding == nil || *next != *nextEmbedding {
+		embeddingSpaceMu.Lock()
+		activeEmbedding, nextEmbedding = active, next
+		embeddingSpaceMu.Unlock()
+		logger.Info("embedding migration finished elsewhere", "active", active)
+		return true
+	}
+
+	for afterID := 0; ; {
+		posts, err := getPostsToReembed(afterID, reembedBatchSize)
+		if err != nil || len(posts) == 0 {
+			break
+		}
+
+		for _, post := range posts {
+			afterID = post.ID
+			// re-embedding is the system's work, not the user's, so it doesn't use up
+			// their daily tokens
+			embedding, err := embedPost(systemUserID, post, *next)
+			if err == nil {
+				err = storePostEmbedding(post.ID, *next, embedding)
+			}
+			if err != nil {
+				logger.Warn("failed to re-embed post", "postID", post.ID, "error", err)
+			}
+		}
+	}
+
+	done, total, err := getReembedProgress()
+	if err != nil {
+		return false
+	}
+	logger.Info("re-embedding progress", "to", *next, "done", done, "total", total)
+	if done < total {
+		return false
+	}
+
+	if err := buildNextEmbeddingIndex(); err != nil {
+		return false
+	}
+
+	embeddingSpaceMu.Lock()
+	defer embeddingSpaceMu.Unlock()
+
+	err = cutOverEmbeddings()
+	if errors.Is(err, errReembedIncomplete) {
+		return false
+	} else if err != nil {
+		logger.Error("failed to cut over to new embeddings", "error", err)
+		return false
+	}
+
+	activeEmbedding, nextEmbedding = *next, nil
+	logger.Info("cut search over to new embeddings", "active", activeEmbedding)
+	return true
+}
@@ -0,0 +1,54 @@
+package main
+
+import "strings"
+
+const relatedPostsCount = 5
+
+// posts more similar than this are taken to be the same article, e.g. saved from a
+// different site or a newer version, and aren't shown as related
+const nearDuplicateSimilarity = 0.97
+
+// getRelatedPosts returns the posts from the user's library nearest to a post by
+// embedding. Results are cached on the post until the user's library version changes,
+// which happens whenever a post gets a new embedding.
+func getRelatedPosts(postID, userID int) ([]Post, error) {
+	ids, version, ok, err := getCachedRelatedPostIDs(postID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return getPostsByIDs(userID, ids)
+	}
+
+	post, err := getPostContent(postID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// get a few extra to make up for the near-duplicates
+	candidates, err := findSimilarPosts(postID, userID, relatedPostsCount*3)
+	if err != nil {
+		return nil, err
+	}
+
+	related := []Post{}
+	ids = []int{}
+	for _, candidate := range candidates {
+		if len(related) == relatedPostsCount {
+			break
+		}
+		if candidate.Similarity >= nearDuplicateSimilarity ||
+			strings.EqualFold(strings.TrimSpace(candidate.Title), strings.TrimSpace(post.Title)) {
+			continue
+		}
+		related = append(related, candidate.Post)
+		ids = append(ids, candidate.ID)
+	}
+
+	// nothing to cache until the post has its embedding
+	if len(candidates) > 0 {
+		cacheRelatedPostIDs(postID, ids, version)
+	}
+
+	return related, nil
+}
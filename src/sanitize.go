@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The node server already runs DOMPurify over extracted articles, but post bodies
+// can reach the db by other routes too, so we sanitize again in Go before every
+// write. Anything not explicitly allowed below is removed.
+
+// elements which are kept, along with the attributes allowed on them
+var allowedElements = map[string][]string{
+	"a": {"href"}, "abbr": nil, "article": nil, "aside": nil, "b": nil, "blockquote": {"cite"},
+	"br": nil, "caption": nil, "cite": nil, "code": nil, "col": {"span"}, "colgroup": {"span"},
+	"dd": nil, "del": nil, "details": nil, "div": nil, "dl": nil, "dt": nil, "em": nil,
+	"figcaption": nil, "figure": nil, "footer": nil, "h1": nil, "h2": nil, "h3": nil, "h4": nil,
+	"h5": nil, "h6": nil, "header": nil, "hr": nil, "i": nil, "img": {"src", "srcset", "alt", "width", "height"},
+	"ins": nil, "kbd": nil, "li": {"value"}, "mark": nil, "ol": {"start", "reversed", "type"},
+	"p": nil, "picture": nil, "pre": nil, "q": {"cite"}, "s": nil, "samp": nil, "section": nil,
+	"small": nil, "source": {"src", "srcset", "type", "media"}, "span": nil, "strong": nil,
+	"sub": nil, "summary": nil, "sup": nil, "table": nil, "tbody": nil, "td": {"colspan", "rowspan"},
+	"tfoot": nil, "th": {"colspan", "rowspan", "scope"}, "thead": nil, "time": {"datetime"},
+	"tr": nil, "u": nil, "ul": nil, "var": nil,
+	"video": {"src", "poster", "controls", "width", "height"}, "audio": {"src", "controls"},
+}
+
+// attributes allowed on any allowed element
+var allowedGlobalAttrs = []string{"id", "title", "lang", "dir"}
+
+// elements which are removed together with everything inside them. unknown elements
+// not in this list are unwrapped instead, so their text content survives.
+var droppedElements = map[string]bool{
+	"script": true, "style": true, "iframe": true, "frame": true, "frameset": true, "object": true,
+	"embed": true, "applet": true, "noscript": true, "template": true, "form": true, "input": true,
+	"button": true, "select": true, "textarea": true, "option": true, "link": true, "meta": true,
+	"base": true, "title": true, "head": true, "svg": true, "math": true, "canvas": true,
+	"dialog": true, "portal": true,
+}
+
+var urlAttrs = map[string]bool{"href": true, "src": true, "cite": true, "poster": true}
+
+// image types allowed in data: urls, svg isn't one as it can carry scripts
+var dataImageTypes = map[string]bool{
+	"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true, "image/avif": true, "image/bmp": true,
+}
+
+// query parameters which only exist to track where a click came from
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "dclid": true, "gbraid": true, "wbraid": true, "msclkid": true,
+	"yclid": true, "twclid": true, "igshid": true, "mc_cid": true, "mc_eid": true, "_hsenc": true,
+	"_hsmi": true, "mkt_tok": true, "ref_src": true, "oly_enc_id": true, "oly_anon_id": true,
+	"vero_id": true, "wickedid": true, "__s": true, "_ga": true, "_gl": true,
+}
+
+// article ids are prefixed so they can't clash with (or clobber) ids used by our own page
+const articleIDPrefix = "article-"
+
+// prefixArticleID is idempotent so already sanitized bodies can be sanitized again.
+func prefixArticleID(id string) string {
+	if strings.HasPrefix(id, articleIDPrefix) {
+		return id
+	}
+	return articleIDPrefix + id
+}
+
+var sanitizeOnRender = os.Getenv("LS2_SANITIZE_ON_RENDER") == "true"
+
+// sanitizeHTML parses an untrusted html fragment and returns it with only allowed
+// elements, attributes and urls left in. Links get rel="noopener noreferrer" and
+// tracking parameters are stripped from all urls.
+func sanitizeHTML(body string) string {
+	parent := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(body), parent)
+	if err != nil {
+		// the parser only fails on read errors, which a strings.Reader never returns
+		return html.EscapeString(body)
+	}
+
+	root := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+	sanitizeChildren(root)
+
+	var buf bytes.Buffer
+	for c := root.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&buf, c); err != nil {
+			return ""
+		}
+	}
+	return buf.String()
+}
+
+func sanitizeChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+
+		switch c.Type {
+		case html.TextNode:
+			// text is escaped again when rendered
+		case html.ElementNode:
+			name := strings.ToLower(c.Data)
+			_, allowed := allowedElements[name]
+			switch {
+			case c.Namespace != "" || droppedElements[name]:
+				n.RemoveChild(c)
+			case allowed:
+				sanitizeAttrs(c, name)
+				sanitizeChildren(c)
+			default:
+				// unwrap, keeping the (sanitized) children in place of the element
+				sanitizeChildren(c)
+				for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+					c.RemoveChild(gc)
+					n.InsertBefore(gc, c)
+				}
+				n.RemoveChild(c)
+			}
+		default:
+			// comments, doctypes etc.
+			n.RemoveChild(c)
+		}
+
+		c = next
+	}
+}
+
+func sanitizeAttrs(n *html.Node, name string) {
+	allowed := allowedElements[name]
+
+	attrs := make([]html.Attribute, 0, len(n.Attr))
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		if a.Namespace != "" || !(contains(allowed, key) || contains(allowedGlobalAttrs, key)) {
+			continue
+		}
+
+		switch {
+		case key == "id":
+			a.Val = prefixArticleID(a.Val)
+		case key == "srcset":
+			val, ok := sanitizeSrcset(a.Val)
+			if !ok {
+				continue
+			}
+			a.Val = val
+		case urlAttrs[key]:
+			val, ok := sanitizeURL(a.Val, name == "img" && key == "src")
+			if !ok {
+				continue
+			}
+			a.Val = val
+		}
+
+		attrs = append(attrs, html.Attribute{Key: key, Val: a.Val})
+	}
+
+	if name == "a" {
+		attrs = append(attrs, html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+	}
+
+	n.Attr = attrs
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeURL returns the cleaned url and whether it's safe to keep at all.
+func sanitizeURL(raw string, allowDataImage bool) (string, bool) {
+	raw = strings.TrimSpace(raw)
+
+	// same page fragment links point at prefixed ids
+	if strings.HasPrefix(raw, "#") {
+		if len(raw) == 1 {
+			return raw, true
+		}
+		return "#" + prefixArticleID(raw[1:]), true
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		stripTrackingParams(u)
+		return u.String(), true
+	case "":
+		// relative url, these shouldn't survive readability but are harmless
+		return raw, true
+	case "mailto":
+		return raw, true
+	case "data":
+		// the media type runs up to the parameters or the data
+		mediaType := strings.ToLower(u.Opaque)
+		if i := strings.IndexAny(mediaType, ";,"); i != -1 {
+			mediaType = mediaType[:i]
+		}
+		if allowDataImage && dataImageTypes[strings.TrimSpace(mediaType)] {
+			return raw, true
+		}
+	}
+
+	return "", false
+}
+
+func sanitizeSrcset(srcset string) (string, bool) {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			return "", false
+		}
+		u, ok := sanitizeURL(fields[0], false)
+		if !ok {
+			return "", false
+		}
+		fields[0] = u
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", "), true
+}
+
+// stripTrackingParams removes utm_* and other known click tracking parameters from u,
+// leaving the others as they were, in order.
+func stripTrackingParams(u *url.URL) {
+	if u.RawQuery == "" {
+		return
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "utm_") || trackingParams[lower] {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+}
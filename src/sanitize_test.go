@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "javascript href",
+			body: `<a href="javascript:alert(1)">x</a>`,
+			want: `<a rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "javascript href with space and capitals",
+			body: `<a href=" JavaScript:alert(1)">x</a>`,
+			want: `<a rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "javascript href with character references",
+			body: `<a href="&#106;ava&#9;script:alert(1)">x</a>`,
+			want: `<a rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "vbscript href",
+			body: `<a href="vbscript:msgbox(1)">x</a>`,
+			want: `<a rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "links get rel and lose target",
+			body: `<a href="https://example.com/a" target="_blank" rel="opener">x</a>`,
+			want: `<a href="https://example.com/a" rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "mailto href",
+			body: `<a href="mailto:a@example.com">x</a>`,
+			want: `<a href="mailto:a@example.com" rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "fragment href points at the prefixed id",
+			body: `<a href="#intro">x</a>`,
+			want: `<a href="#article-intro" rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "ids are prefixed",
+			body: `<h2 id="intro">t</h2>`,
+			want: `<h2 id="article-intro">t</h2>`,
+		},
+		{
+			name: "ids are prefixed once",
+			body: `<h2 id="article-intro">t</h2>`,
+			want: `<h2 id="article-intro">t</h2>`,
+		},
+		{
+			name: "raster data image",
+			body: `<img src="data:image/png;base64,iVBORw0KGgo=">`,
+			want: `<img src="data:image/png;base64,iVBORw0KGgo="/>`,
+		},
+		{
+			name: "svg data image",
+			body: `<img src="data:image/svg+xml;base64,PHN2Zz4=">`,
+			want: `<img/>`,
+		},
+		{
+			name: "html data url in an image",
+			body: `<img src="data:text/html,<script>alert(1)</script>">`,
+			want: `<img/>`,
+		},
+		{
+			name: "data url in a link",
+			body: `<a href="data:image/png;base64,iVBORw0KGgo=">x</a>`,
+			want: `<a rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "event handler attributes",
+			body: `<img src="a.png" onerror="alert(1)" onload="x()">`,
+			want: `<img src="a.png"/>`,
+		},
+		{
+			name: "attributes which aren't allowed",
+			body: `<p onclick="x()" style="color:red" class="c">t</p>`,
+			want: `<p>t</p>`,
+		},
+		{
+			name: "srcset urls are cleaned",
+			body: `<img srcset="https://example.com/a.png 1x, https://example.com/b.png?utm_source=x 2x">`,
+			want: `<img srcset="https://example.com/a.png 1x, https://example.com/b.png 2x"/>`,
+		},
+		{
+			name: "srcset with an unsafe url",
+			body: `<img srcset="https://example.com/a.png 1x, javascript:alert(1) 2x" src="https://example.com/a.png">`,
+			want: `<img src="https://example.com/a.png"/>`,
+		},
+		{
+			name: "srcset with a data url",
+			body: `<img srcset="data:image/png;base64,iVBORw0KGgo= 1x">`,
+			want: `<img/>`,
+		},
+		{
+			name: "tracking params are stripped from links",
+			body: `<a href="https://example.com/?b=2&utm_source=x&a=1&fbclid=y&c=3">x</a>`,
+			want: `<a href="https://example.com/?b=2&amp;a=1&amp;c=3" rel="noopener noreferrer">x</a>`,
+		},
+		{
+			name: "scripts are dropped",
+			body: `<script>alert(1)</script><p>a</p>`,
+			want: `<p>a</p>`,
+		},
+		{
+			name: "svg is dropped with what's in it",
+			body: `<svg><script>alert(1)</script></svg>t`,
+			want: `t`,
+		},
+		{
+			name: "unknown elements are unwrapped",
+			body: `<custom><b>kept</b></custom>`,
+			want: `<b>kept</b>`,
+		},
+		{
+			name: "comments",
+			body: `<!-- c --><p>t</p>`,
+			want: `<p>t</p>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeHTML(tt.body)
+			if got != tt.want {
+				t.Errorf("sanitizeHTML(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+			// bodies are sanitized again on every write
+			if again := sanitizeHTML(got); again != got {
+				t.Errorf("sanitizeHTML(%q) = %q, sanitizing it again gives %q", tt.body, got, again)
+			}
+		})
+	}
+}
+
+func TestSanitizeURL(t *testing.T) {
+	tests := []struct {
+		raw            string
+		allowDataImage bool
+		want           string
+		ok             bool
+	}{
+		{raw: "https://example.com/a", want: "https://example.com/a", ok: true},
+		{raw: "  http://example.com/a ", want: "http://example.com/a", ok: true},
+		{raw: "/relative/path", want: "/relative/path", ok: true},
+		{raw: "#", want: "#", ok: true},
+		{raw: "javascript:alert(1)"},
+		{raw: "JAVASCRIPT:alert(1)"},
+		{raw: "vbscript:msgbox(1)"},
+		{raw: "file:///etc/passwd"},
+		{raw: "data:image/gif;base64,R0lGOD==", allowDataImage: true, want: "data:image/gif;base64,R0lGOD==", ok: true},
+		{raw: "data:image/gif;base64,R0lGOD=="},
+		{raw: "data:image/svg+xml,<svg/>", allowDataImage: true},
+		{raw: "data:text/html;base64,PHNjcmlwdD4=", allowDataImage: true},
+	}
+
+	for _, tt := range tests {
+		got, ok := sanitizeURL(tt.raw, tt.allowDataImage)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("sanitizeURL(%q, %v) = %q, %v, want %q, %v", tt.raw, tt.allowDataImage, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStripTrackingParams(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "https://example.com/a", want: "https://example.com/a"},
+		{raw: "https://example.com/a?z=1&b=2", want: "https://example.com/a?z=1&b=2"},
+		{raw: "https://example.com/a?z=1&utm_source=x&b=2&UTM_Medium=y", want: "https://example.com/a?z=1&b=2"},
+		{raw: "https://example.com/a?fbclid=x&z=1&gclid=y&b=2", want: "https://example.com/a?z=1&b=2"},
+		{raw: "https://example.com/a?utm_source=x&fbclid=y", want: "https://example.com/a"},
+		{raw: "https://example.com/a?utm%5Fsource=x&q=a%20b", want: "https://example.com/a?q=a%20b"},
+		{raw: "https://example.com/a?ref=x#utm_source", want: "https://example.com/a?ref=x#utm_source"},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stripTrackingParams(u)
+		if got := u.String(); got != tt.want {
+			t.Errorf("stripTrackingParams(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// A search is a query, by meaning or by title and site, narrowed down by filters on
+// post state and length. /query runs them as the user types, and saved searches keep
+// them under a name, so a saved search always lists what searching for it would.
+
+const searchResultLimit = 20
+
+// saved searches list at most this many posts, and count up to it
+const savedSearchLimit = 100
+
+// posts less similar than this to a semantic query don't match it, so a search has a
+// set of results which can be counted rather than just the nearest few posts
+const minSearchSimilarity = 0.2
+
+const maxSavedSearchNameLength = 50
+
+// SearchState filters search results by the state of the post.
+type SearchState struct {
+	Key   string
+	Label string
+	cond  string
+}
+
+var searchStates = []SearchState{
+	{Key: "", Label: "Any state", cond: "state <> 'trashed'"},
+	{Key: "unread", Label: "Unread", cond: "state IN ('inbox', 'reading')"},
+	{Key: "read", Label: "Read", cond: "state = 'archived'"},
+	{Key: "liked", Label: "Liked", cond: "state <> 'trashed' AND is_liked"},
+}
+
+func getSearchState(key string) SearchState {
+	for _, state := range searchStates {
+		if state.Key == key {
+			return state
+		}
+	}
+	return searchStates[0]
+}
+
+const searchModeFind = "find"
+
+type Search struct {
+	Query string
+	// "" to search by meaning, searchModeFind to match titles and sites
+	Mode   string
+	State  SearchState
+	Length LengthFilter
+}
+
+func searchFromForm(form url.Values) Search {
+	search := Search{
+		Query:  normalizeQuery(form.Get("query")),
+		State:  getSearchState(form.Get("state")),
+		Length: getLengthFilter(form.Get("length")),
+	}
+	if form.Get("mode") == searchModeFind {
+		search.Mode = searchModeFind
+	}
+	return search
+}
+
+// IsEmpty reports whether the search has neither a query nor filters.
+func (s Search) IsEmpty() bool {
+	return s.Query == "" && s.State.Key == "" && s.Length.Key == ""
+}
+
+// Values are the form values searchFromForm makes the search from.
+func (s Search) Values() url.Values {
+	values := url.Values{}
+	for name, value := range map[string]string{"query": s.Query, "mode": s.Mode, "state": s.State.Key, "length": s.Length.Key} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	return values
+}
+
+// URL opens the search on the search page.
+func (s Search) URL() string {
+	return "/search?" + s.Values().Encode()
+}
+
+// Description sums up the search, like `"go" · Unread · Under 15 minutes`.
+func (s Search) Description() string {
+	var parts []string
+	if s.Query != "" {
+		query := fmt.Sprintf("%q", s.Query)
+		if s.Mode == searchModeFind {
+			query = "Title or site like " + query
+		}
+		parts = append(parts, query)
+	}
+	if s.State.Key != "" {
+		parts = append(parts, s.State.Label)
+	}
+	if s.Length.Key != "" {
+		parts = append(parts, s.Length.Label)
+	}
+	return strings.Join(parts, " · ")
+}
+
+// filterSQL returns the conditions on posts the filters make, to AND with the user's.
+func (s Search) filterSQL() string {
+	conds := []string{s.State.cond}
+	if cond := s.Length.sql(); cond != "" {
+		conds = append(conds, cond)
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// searchPosts returns up to limit posts matching the search, best matches first, or
+// newest first without a query. If the query can't be embedded, posts are found by
+// full text search instead and fullText is true. With exact, searches by meaning find
+// every matching post rather than going through the index, for saved searches, which
+// list as many posts as countSearchPosts counts.
+func searchPosts(userID int, search Search, limit int, exact bool) (posts []Post, fullText bool, err error) {
+	filter := search.filterSQL()
+
+	switch {
+	case search.Query == "":
+		posts, err = getFilteredPosts(userID, filter, limit)
+	case search.Mode == searchModeFind:
+		// matches titles and sites as typed, without the embeddings api
+		posts, err = quickFindPosts(userID, search.Query, filter, limit)
+	default:
+		embedding, embedErr := getQueryEmbedding(userID, currentEmbeddingSpace(), search.Query)
+		if errors.Is(embedErr, errEmbeddingQuotaExceeded) {
+			return nil, false, embedErr
+		} else if embedErr != nil {
+			// full text search still works while the embeddings api doesn't
+			slog.Error("failed to get query embedding, falling back to full text search",
+				"userID", userID, "error", embedErr)
+			return searchUserPosts(userID, search.Query, filter, limit), true, nil
+		}
+		posts = searchUserPostsByEmbedding(userID, embedding, filter, limit, exact)
+	}
+
+	return posts, false, err
+}
+
+type SavedSearch struct {
+	ID     int
+	Name   string
+	Search Search
+	// how many posts match it, up to savedSearchLimit+1, when listed in the menu and
+	// Counted
+	Count   int
+	Counted bool
+}
+
+func (s SavedSearch) CountLabel() string {
+	if !s.Counted {
+		return ""
+	}
+	if s.Count > savedSearchLimit {
+		return fmt.Sprintf("%v+", savedSearchLimit)
+	}
+	return fmt.Sprint(s.Count)
+}
+
+// The menu lists saved searches with their counts each time it opens, so the counts
+// are kept until the user's posts change, which bumps posts_version.
+
+type savedSearchCount struct {
+	postsVersion int64
+	count        int
+}
+
+var (
+	savedSearchCountsMu sync.Mutex
+	// by saved search id
+	savedSearchCounts = map[int]savedSearchCount{}
+)
+
+// countSavedSearches sets the counts of the user's saved searches. They're counted in
+// the database without the embeddings api, so searches by meaning whose query
+// embedding isn't cached are left uncounted until they're next run.
+func countSavedSearches(userID int, searches []SavedSearch) error {
+	version, err := getPostsVersion(userID)
+	if err != nil {
+		return err
+	}
+
+	for i := range searches {
+		s := &searches[i]
+
+		savedSearchCountsMu.Lock()
+		cached, ok := savedSearchCounts[s.ID]
+		savedSearchCountsMu.Unlock()
+		if ok && cached.postsVersion == version {
+			s.Count, s.Counted = cached.count, true
+			continue
+		}
+
+		var embedding []float32
+		if s.Search.Query != "" && s.Search.Mode != searchModeFind {
+			if embedding, ok = cachedQueryEmbedding(userID, currentEmbeddingSpace(), s.Search.Query); !ok {
+				continue
+			}
+		}
+
+		// one more than the limit tells there are more
+		count, err := countSearchPosts(userID, s.Search, embedding, savedSearchLimit+1)
+		if err != nil {
+			return err
+		}
+		s.Count, s.Counted = count, true
+
+		savedSearchCountsMu.Lock()
+		savedSearchCounts[s.ID] = savedSearchCount{postsVersion: version, count: count}
+		savedSearchCountsMu.Unlock()
+	}
+
+	return nil
+}
+
+// forgetSavedSearchCount drops the kept count of a deleted saved search.
+func forgetSavedSearchCount(id int) {
+	savedSearchCountsMu.Lock()
+	defer savedSearchCountsMu.Unlock()
+	delete(savedSearchCounts, id)
+}
+
+// normalizeSavedSearchName collapses whitespace in a name and checks its length.
+func normalizeSavedSearchName(name string) (string, bool) {
+	name = strings.Join(strings.Fields(name), " ")
+	n := len([]rune(name))
+	return name, n > 0 && n <= maxSavedSearchNameLength
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+// browsers send these without our headers, so they can't carry a csrf token
+var csrfExemptPaths = map[string]bool{
+	"/csp-report": true,
+}
+
+// the browser extension saves posts and marks them read without our pages, so it has
+// no csrf token to send
+var extensionPaths = map[string]bool{
+	"/save":      true,
+	"/mark-read": true,
+}
+
+// browsers set the Origin of requests from extensions to one of these schemes, which
+// web pages can't send
+var extensionOriginSchemes = []string{"chrome-extension://", "moz-extension://", "safari-web-extension://"}
+
+// isExtensionRequest reports whether the request comes from a browser extension allowed
+// to call extensionPaths. LS2_EXTENSION_ORIGINS limits this to a comma separated list
+// of extension origins, any extension is allowed without it.
+func isExtensionRequest(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if !extensionPaths[r.URL.Path] || !slices.ContainsFunc(extensionOriginSchemes, func(scheme string) bool {
+		return strings.HasPrefix(origin, scheme)
+	}) {
+		return false
+	}
+
+	allowed := os.Getenv("LS2_EXTENSION_ORIGINS")
+	if allowed == "" {
+		return true
+	}
+	for _, o := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(o) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func generateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// csrfMiddleware implements the double-submit cookie pattern. Every client gets a
+// random token in a cookie, and state-changing requests must echo it back in the
+// X-CSRF-Token header (htmx does this via hx-headers in base.html) or a form field.
+// The browser extension is recognized by its Origin instead, see isExtensionRequest.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if c, err := r.Cookie(csrfCookieName); err == nil {
+			token = c.Value
+		}
+
+		if token == "" {
+			var err error
+			token, err = generateRandomToken()
+			if err != nil {
+				logAndRespondInternalError(slog.Default(), "failed to generate csrf token", w, err)
+				return
+			}
+
+			// long lived and never rotated, so that cached pages keep a valid token
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Expires:  time.Now().Add(365 * 24 * time.Hour),
+				HttpOnly: true,
+				Secure:   os.Getenv("ENV") == "production",
+				SameSite: http.SameSiteLaxMode,
+				Path:     "/",
+			})
+		}
+
+		if !isSafeMethod(r.Method) && !csrfExemptPaths[r.URL.Path] && !isExtensionRequest(r) {
+			sent := r.Header.Get(csrfHeaderName)
+			if sent == "" {
+				sent = r.PostFormValue(csrfFormField)
+			}
+
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				slog.Warn("csrf token mismatch", "method", r.Method, "path", r.URL.Path)
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), csrfTokenKey, token))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getCSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfTokenKey).(string)
+	return token
+}
+
+// baseTemplateData adds the per-request values needed by base.html to data.
+func baseTemplateData(r *http.Request, data map[string]any) map[string]any {
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["CSRFToken"] = getCSRFToken(r)
+	data["CSPNonce"] = getCSPNonce(r)
+	return data
+}
+
+// Article bodies come from arbitrary sites, so images and media may be loaded from
+// anywhere, but scripts only run if they're ours: served by us or carrying the nonce,
+// which the htmx script tags in base.html do.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'nonce-%s'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src * data: blob:; " +
+	"media-src *; " +
+	"font-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"frame-src 'none'; " +
+	"object-src 'none'; " +
+	"base-uri 'none'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'; " +
+	"report-uri /csp-report; " +
+	"report-to csp"
+
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := generateRandomToken()
+		if err != nil {
+			logAndRespondInternalError(slog.Default(), "failed to generate csp nonce", w, err)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Content-Security-Policy", fmt.Sprintf(contentSecurityPolicy, nonce))
+		h.Set("Reporting-Endpoints", `csp="/csp-report"`)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		h.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(), payment=(), usb=()")
+		if os.Getenv("ENV") == "production" {
+			h.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), cspNonceKey, nonce))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getCSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey).(string)
+	return nonce
+}
+
+const maxCSPReportSize = 64 * 1024
+
+// cspReportHandler accepts both the legacy report-uri format (application/csp-report)
+// and the Reporting API format (application/reports+json) and logs them.
+func cspReportHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCSPReportSize))
+	if err != nil {
+		respondBadRequest(w)
+		return
+	}
+
+	var report any
+	if err := json.Unmarshal(body, &report); err != nil {
+		slog.Warn("malformed csp report", "error", err, "contentType", r.Header.Get("Content-Type"))
+		respondBadRequest(w)
+		return
+	}
+
+	slog.Warn("csp violation", "report", report, "userAgent", r.UserAgent())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondNotModified writes a 304. The csp header is left out, since browsers update
+// the cached response's headers from a 304 and the cached body has the old nonce.
+func respondNotModified(w http.ResponseWriter) {
+	w.Header().Del("Content-Security-Policy")
+	w.Header().Del("Reporting-Endpoints")
+	w.WriteHeader(http.StatusNotModified)
+}
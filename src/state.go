@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// A post is always in one of these states. New posts start in the inbox, move to
+// reading once started, and to archived once read; /saved lists the first two and
+// /read the archive. Any of them can be trashed, and trashed posts are deleted for
+// good after trashRetention unless restored. Liked is a separate flag.
+const (
+	stateInbox    = "inbox"
+	stateReading  = "reading"
+	stateArchived = "archived"
+	stateTrashed  = "trashed"
+)
+
+// postStateTransitions maps each state to the states a post can move to it from.
+// Nothing moves out of the trash here: leaving it only goes through restorePost,
+// which returns the post to the state it was trashed from.
+var postStateTransitions = map[string][]string{
+	stateInbox:    {stateReading, stateArchived},
+	stateReading:  {stateInbox, stateArchived},
+	stateArchived: {stateInbox, stateReading},
+	stateTrashed:  {stateInbox, stateReading, stateArchived},
+}
+
+var errInvalidState = errors.New("invalid post state")
+
+func isValidState(state string) bool {
+	_, ok := postStateTransitions[state]
+	return ok
+}
+
+const trashRetention = 30 * 24 * time.Hour
+
+const trashPurgeInterval = time.Hour
+
+// runTrashPurger deletes posts which have been in the trash for longer than
+// trashRetention, checking every trashPurgeInterval.
+func runTrashPurger() {
+	for {
+		deleted, err := purgeTrashedPosts(time.Now().Add(-trashRetention).Unix())
+		if err != nil {
+			slog.Error("failed to purge trashed posts", "error", err)
+		} else if deleted > 0 {
+			slog.Info("purged trashed posts", "count", deleted)
+		}
+
+		time.Sleep(trashPurgeInterval)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Users who turn summaries on get a short TL;DR and key points for each post they
+// save. Saving only queues the post, a background worker then summarizes queued
+// posts one at a time, the same way the import worker extracts articles.
+
+// Summarizer condenses an article into a summary.
+type Summarizer interface {
+	Summarize(ctx context.Context, title, text string) (Summary, error)
+}
+
+type Summary struct {
+	TLDR      string   `json:"tldr"`
+	KeyPoints []string `json:"key_points"`
+}
+
+var summarizer Summarizer
+
+const defaultSummaryModel = "gpt-4o-mini"
+
+// articles are cut to this many characters before summarizing, which keeps the cost
+// per post bounded and fits the context of small local models
+const maxSummaryInputChars = 24000
+
+const (
+	maxSummaryLength    = 1000
+	maxSummaryPoints    = 7
+	maxKeyPointLength   = 300
+	summaryTimeout      = 2 * time.Minute
+	summaryPollInterval = 30 * time.Second
+)
+
+var errEmptySummary = errors.New("summarizer returned an empty summary")
+
+// initSummarizer sets up summaries with the OpenAI client used for embeddings, or
+// with a separate OpenAI compatible endpoint if LS2_SUMMARY_BASE_URL is set.
+func initSummarizer() {
+	summaryClient := client
+	if baseURL := os.Getenv("LS2_SUMMARY_BASE_URL"); baseURL != "" {
+		summaryClient = newOpenAIClient(os.Getenv("LS2_SUMMARY_API_KEY"), baseURL)
+	}
+
+	model := os.Getenv("LS2_SUMMARY_MODEL")
+	if model == "" {
+		model = defaultSummaryModel
+	}
+
+	summarizer = openAISummarizer{client: summaryClient, model: model}
+}
+
+// openAISummarizer summarizes with a chat completion model.
+type openAISummarizer struct {
+	client *openai.Client
+	model  string
+}
+
+const summaryPrompt = `Summarize the article the user sends. Reply with only a JSON object of the form
+{"tldr": "...", "key_points": ["...", "..."]}
+where tldr is one or two sentences and key_points are 3 to 5 short sentences covering the main points. ` +
+	`Write in the language of the article and don't add anything which isn't in it.`
+
+func (s openAISummarizer) Summarize(ctx context.Context, title, text string) (Summary, error) {
+	resp, err := s.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: s.model,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summaryPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: "# " + title + "\n\n" + text},
+		},
+		Temperature: 0.2,
+	})
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to create summary: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return Summary{}, errEmptySummary
+	}
+
+	return parseSummary(resp.Choices[0].Message.Content)
+}
+
+// parseSummary reads the JSON object out of a model's reply. Not every compatible
+// server supports forcing JSON output, so text around the object is ignored.
+func parseSummary(reply string) (Summary, error) {
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start == -1 || end < start {
+		return Summary{}, fmt.Errorf("no json object in summary reply")
+	}
+
+	var summary Summary
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &summary); err != nil {
+		return Summary{}, fmt.Errorf("failed to parse summary reply: %w", err)
+	}
+
+	summary.TLDR = truncateText(strings.TrimSpace(summary.TLDR), maxSummaryLength)
+	var points []string
+	for _, point := range summary.KeyPoints {
+		if point = strings.TrimSpace(point); point != "" && len(points) < maxSummaryPoints {
+			points = append(points, truncateText(point, maxKeyPointLength))
+		}
+	}
+	summary.KeyPoints = points
+
+	if summary.TLDR == "" && len(summary.KeyPoints) == 0 {
+		return Summary{}, errEmptySummary
+	}
+
+	return summary, nil
+}
+
+// summaryWakeup is signalled whenever a post is queued for summarizing.
+var summaryWakeup = make(chan struct{}, 1)
+
+// queueSummary queues a post for summarizing if its user has summaries turned on.
+func queueSummary(postID, userID int) {
+	queued, err := queuePostSummary(postID, userID)
+	if err != nil {
+		slog.Error("failed to queue post summary", "postID", postID, "error", err)
+		return
+	}
+	if queued {
+		select {
+		case summaryWakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runSummaryWorker summarizes queued posts forever.
+func runSummaryWorker() {
+	if err := resetProcessingSummaries(); err != nil {
+		slog.Error("failed to reset interrupted summaries", "error", err)
+	}
+
+	for {
+		post, ok, err := claimPendingSummary()
+		if err != nil {
+			slog.Error("failed to claim post to summarize", "error", err)
+		}
+		if !ok || err != nil {
+			select {
+			case <-summaryWakeup:
+			case <-time.After(summaryPollInterval):
+			}
+			continue
+		}
+
+		summarizePost(post)
+	}
+}
+
+func summarizePost(post Post) {
+	logger := slog.Default().With("func", "summarizePost", "postID", post.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+	defer cancel()
+
+	text := truncateText(htmlToMarkdown(post.Body), maxSummaryInputChars)
+	summary, err := summarizer.Summarize(ctx, post.Title, text)
+	if err != nil {
+		logger.Warn("failed to summarize post", "error", err)
+		finishPostSummary(post.ID, Summary{}, false)
+		return
+	}
+
+	finishPostSummary(post.ID, summary, true)
+	logger.Info("summarized post")
+}
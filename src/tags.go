@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tag suggestions for a new post come from two places: how close its embedding is to
+// the centroid of each of the user's tags, and which tags the nearest already tagged
+// posts have, weighted by how near they are. The confidence is the average of the two.
+
+const maxTagLength = 50
+
+const maxSuggestedTags = 3
+
+// number of nearest tagged posts which vote on the tags
+const tagNeighbours = 10
+
+// suggestions below this confidence aren't shown
+const minTagConfidence = 0.35
+
+// saving a post waits this long for its embedding to suggest tags, then responds
+// without suggestions
+const tagSuggestionTimeout = 5 * time.Second
+
+// cosine similarities between embeddings of related articles mostly fall in this
+// range, so it's what the centroid similarity is scaled over
+const (
+	tagSimilarityFloor   = 0.2
+	tagSimilarityCeiling = 0.7
+)
+
+var errInvalidTag = errors.New("invalid tag name")
+
+// TagSuggestion is a tag proposed for a post, with a confidence between 0 and 1.
+type TagSuggestion struct {
+	Name       string
+	Confidence float64
+}
+
+func (s TagSuggestion) Percent() int {
+	return int(math.Round(s.Confidence * 100))
+}
+
+// normalizeTag returns the tag name as stored: lower case, trimmed, with runs of
+// whitespace collapsed.
+func normalizeTag(name string) (string, error) {
+	name = strings.Join(strings.Fields(strings.ToLower(name)), " ")
+	if name == "" || len([]rune(name)) > maxTagLength {
+		return "", errInvalidTag
+	}
+	return name, nil
+}
+
+// tagNeighbour is one tag of one of the nearest tagged posts.
+type tagNeighbour struct {
+	postID     int
+	similarity float64
+	tag        string
+}
+
+// scoreTagSuggestions combines the similarity of the post to each tag's centroid with
+// the votes of the nearest tagged posts, returning the best suggestions first.
+func scoreTagSuggestions(centroidSimilarity map[string]float64, neighbours []tagNeighbour) []TagSuggestion {
+	votes := map[string]float64{}
+	totalVotes := 0.0
+	counted := map[int]bool{}
+	for _, n := range neighbours {
+		similarity := max(n.similarity, 0)
+		votes[n.tag] += similarity
+		if !counted[n.postID] {
+			counted[n.postID] = true
+			totalVotes += similarity
+		}
+	}
+
+	var suggestions []TagSuggestion
+	for tag, similarity := range centroidSimilarity {
+		centroidScore := (similarity - tagSimilarityFloor) / (tagSimilarityCeiling - tagSimilarityFloor)
+		centroidScore = max(0, min(centroidScore, 1))
+
+		voteScore := 0.0
+		if totalVotes > 0 {
+			voteScore = votes[tag] / totalVotes
+		}
+
+		confidence := (centroidScore + voteScore) / 2
+		if confidence >= minTagConfidence {
+			suggestions = append(suggestions, TagSuggestion{Name: tag, Confidence: confidence})
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Confidence != suggestions[j].Confidence {
+			return suggestions[i].Confidence > suggestions[j].Confidence
+		}
+		return suggestions[i].Name < suggestions[j].Name
+	})
+
+	return suggestions[:min(len(suggestions), maxSuggestedTags)]
+}
+
+// suggestTags returns tags for a post with the given embedding, based on the user's
+// other tagged posts.
+func suggestTags(postID, userID int, embedding []float32) ([]TagSuggestion, error) {
+	centroidSimilarity, err := getTagCentroidSimilarities(postID, userID, embedding)
+	if err != nil || len(centroidSimilarity) == 0 {
+		return nil, err
+	}
+
+	neighbours, err := getNearestTaggedPosts(postID, userID, embedding, tagNeighbours)
+	if err != nil {
+		return nil, err
+	}
+
+	return scoreTagSuggestions(centroidSimilarity, neighbours), nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Topics group each user's library by clustering the post embeddings with spherical
+// k-means. Clustering everything again is only done once the library has grown by
+// topicsReclusterGrowth since the last time; in between, new posts are put in the
+// topic with the nearest centroid and the centroids and labels are updated.
+
+const topicsInterval = 10 * time.Minute
+
+// users with fewer posts than this don't get topics, there's nothing to organize
+const minPostsForTopics = 10
+
+const maxTopics = 30
+
+const topicsReclusterGrowth = 0.25
+
+const kmeansIterations = 50
+
+// Topic is a cluster of a user's posts, labelled with its most distinctive title terms.
+type Topic struct {
+	ID    int
+	Label string
+	Size  int
+}
+
+// topicPoint is a post as input to the clustering.
+type topicPoint struct {
+	postID    int
+	title     string
+	embedding []float32
+	// index into the topics being computed, -1 if not assigned yet
+	topic int
+}
+
+// runTopicClusterer updates the topics of every user whose library changed since
+// their topics were last computed, checking every topicsInterval.
+func runTopicClusterer() {
+	for {
+		userIDs, err := getUsersWithStaleTopics()
+		if err != nil {
+			slog.Error("failed to get users with stale topics", "error", err)
+		}
+
+		for _, userID := range userIDs {
+			if err := updateTopics(userID); err != nil {
+				slog.Error("failed to update topics", "userID", userID, "error", err)
+			}
+		}
+
+		time.Sleep(topicsInterval)
+	}
+}
+
+func updateTopics(userID int) error {
+	logger := slog.Default().With("func", "updateTopics", "userID", userID)
+
+	state, err := getTopicsState(userID)
+	if err != nil {
+		return err
+	}
+
+	points, topicIDs, err := getTopicPoints(userID)
+	if err != nil {
+		return err
+	}
+
+	if len(points) < minPostsForTopics {
+		return saveTopics(userID, nil, nil, state.libraryVersion, 0)
+	}
+
+	unassigned := 0
+	for _, p := range points {
+		if p.topic == -1 {
+			unassigned++
+		}
+	}
+
+	full := len(topicIDs) == 0 ||
+		float64(len(points)) >= float64(state.clusteredPostCount)*(1+topicsReclusterGrowth)
+	if full {
+		k := int(math.Round(math.Sqrt(float64(len(points)) / 2)))
+		k = max(2, min(k, maxTopics))
+		kmeans(points, k, rand.New(rand.NewPCG(uint64(userID), 0)))
+		topicIDs = make([]int, k)
+		state.clusteredPostCount = len(points)
+		logger.Info("clustered library", "posts", len(points), "topics", k)
+	} else {
+		centroids := computeCentroids(points, len(topicIDs))
+		for i := range points {
+			if points[i].topic == -1 {
+				points[i].topic = nearestCentroid(points[i].embedding, centroids)
+			}
+		}
+		logger.Info("assigned new posts to topics", "posts", unassigned)
+	}
+
+	labels := labelTopics(points, len(topicIDs))
+	topics := make([]Topic, len(topicIDs))
+	for i := range topics {
+		topics[i] = Topic{ID: topicIDs[i], Label: labels[i]}
+	}
+	for _, p := range points {
+		topics[p.topic].Size++
+	}
+
+	return saveTopics(userID, topics, points, state.libraryVersion, state.clusteredPostCount)
+}
+
+// kmeans clusters the points into k topics by cosine similarity, starting from
+// k-means++ seeds. The embeddings are normalized, so the similarity is the dot product.
+func kmeans(points []topicPoint, k int, rng *rand.Rand) {
+	centroids := [][]float32{points[rng.IntN(len(points))].embedding}
+	distances := make([]float64, len(points))
+	for len(centroids) < k {
+		total := 0.0
+		for i, p := range points {
+			distances[i] = 1 - float64(dot(p.embedding, centroids[nearestCentroid(p.embedding, centroids)]))
+			distances[i] *= distances[i]
+			total += distances[i]
+		}
+
+		target := rng.Float64() * total
+		next := len(points) - 1
+		for i, d := range distances {
+			target -= d
+			if target <= 0 {
+				next = i
+				break
+			}
+		}
+		centroids = append(centroids, points[next].embedding)
+	}
+
+	for i := range points {
+		points[i].topic = -1
+	}
+	for iter := 0; iter < kmeansIterations; iter++ {
+		changed := false
+		for i := range points {
+			nearest := nearestCentroid(points[i].embedding, centroids)
+			if nearest != points[i].topic {
+				points[i].topic = nearest
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		centroids = computeCentroids(points, k)
+	}
+}
+
+// computeCentroids returns the normalized mean embedding of each topic. A topic with
+// no posts gets a zero centroid, which nothing is nearest to.
+func computeCentroids(points []topicPoint, k int) [][]float32 {
+	centroids := make([][]float32, k)
+	for _, p := range points {
+		if p.topic == -1 {
+			continue
+		}
+		if centroids[p.topic] == nil {
+			centroids[p.topic] = make([]float32, len(p.embedding))
+		}
+		for i, v := range p.embedding {
+			centroids[p.topic][i] += v
+		}
+	}
+
+	for i := range centroids {
+		if centroids[i] == nil {
+			centroids[i] = make([]float32, len(points[0].embedding))
+			continue
+		}
+		normalize(centroids[i])
+	}
+	return centroids
+}
+
+func nearestCentroid(embedding []float32, centroids [][]float32) int {
+	best, bestSimilarity := 0, float32(math.Inf(-1))
+	for i, centroid := range centroids {
+		if similarity := dot(embedding, centroid); similarity > bestSimilarity {
+			best, bestSimilarity = i, similarity
+		}
+	}
+	return best
+}
+
+func dot(a, b []float32) float32 {
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+const topicLabelTerms = 3
+
+// labelTopics labels each topic with the title terms which are most common in the
+// topic compared to the rest of the library, scored by the share of the topic's
+// titles containing the term times its inverse document frequency.
+func labelTopics(points []topicPoint, k int) []string {
+	docFreq := map[string]int{}
+	topicFreq := make([]map[string]int, k)
+	sizes := make([]int, k)
+	for i := range topicFreq {
+		topicFreq[i] = map[string]int{}
+	}
+	for _, p := range points {
+		sizes[p.topic]++
+		for term := range textTerms(p.title) {
+			docFreq[term]++
+			topicFreq[p.topic][term]++
+		}
+	}
+
+	labels := make([]string, k)
+	for i := range labels {
+		type scoredTerm struct {
+			term  string
+			score float64
+		}
+		var terms []scoredTerm
+		for term, count := range topicFreq[i] {
+			// a term in a single title says nothing about the topic, unless it's tiny
+			if count < 2 && sizes[i] > 2 {
+				continue
+			}
+			idf := math.Log(float64(len(points)) / float64(docFreq[term]))
+			terms = append(terms, scoredTerm{term, float64(count) / float64(sizes[i]) * idf})
+		}
+		sort.Slice(terms, func(a, b int) bool {
+			if terms[a].score != terms[b].score {
+				return terms[a].score > terms[b].score
+			}
+			return terms[a].term < terms[b].term
+		})
+
+		var parts []string
+		for _, t := range terms[:min(len(terms), topicLabelTerms)] {
+			parts = append(parts, t.term)
+		}
+		labels[i] = strings.Join(parts, ", ")
+		if labels[i] == "" {
+			labels[i] = "Miscellaneous"
+		}
+	}
+	return labels
+}
+
+var termStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "from": true, "that": true, "this": true,
+	"are": true, "was": true, "you": true, "your": true, "how": true, "why": true, "what": true,
+	"when": true, "who": true, "its": true, "into": true, "about": true, "not": true, "but": true,
+	"can": true, "all": true, "our": true, "out": true, "new": true, "has": true, "have": true,
+	"will": true, "more": true, "than": true, "they": true, "their": true, "one": true, "part": true,
+	"an": true, "as": true, "at": true, "be": true, "by": true, "do": true, "in": true, "is": true,
+	"it": true, "me": true, "my": true, "no": true, "of": true, "on": true, "or": true, "so": true,
+	"to": true, "up": true, "us": true, "we": true,
+}
+
+// titleTerms returns the distinct lower case words of a title worth labelling with.
+func textTerms(text string) map[string]bool {
+	terms := map[string]bool{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if len([]rune(word)) < 2 || termStopWords[word] || strings.IndexFunc(word, unicode.IsLetter) == -1 {
+			continue
+		}
+		terms[word] = true
+	}
+	return terms
+}